@@ -0,0 +1,185 @@
+package quack
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Settings are the field section related HTTP/3 SETTINGS of an endpoint.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-configuration
+type Settings struct {
+	// MaxTableCapacity is SETTINGS_QPACK_MAX_TABLE_CAPACITY.
+	MaxTableCapacity uint64
+	// BlockedStreams is SETTINGS_QPACK_BLOCKED_STREAMS.
+	BlockedStreams uint64
+	// MaxFieldSectionSize is SETTINGS_MAX_FIELD_SECTION_SIZE, 0 if
+	// unlimited.
+	MaxFieldSectionSize uint64
+	// EnableConnectProtocol is SETTINGS_ENABLE_CONNECT_PROTOCOL, permitting
+	// extended CONNECT requests.
+	// https://www.rfc-editor.org/rfc/rfc9220.html#name-http-3-settings-parameter
+	EnableConnectProtocol bool
+}
+
+// options returns the Options applying s.
+func (s Settings) options() []Option {
+	return []Option{
+		MaxTableCapacity(s.MaxTableCapacity),
+		MaxBlockedStreams(s.BlockedStreams),
+		MaxFieldSectionSize(s.MaxFieldSectionSize),
+	}
+}
+
+var errConnectProtocolDisabled = errors.New(":protocol without SETTINGS_ENABLE_CONNECT_PROTOCOL")
+
+// Conn pairs the Encoder and Decoder of an HTTP/3 connection.
+type Conn struct {
+	encoder *Encoder
+	decoder *Decoder
+	// local and peer are the SETTINGS of each endpoint.
+	local, peer Settings
+}
+
+// NewConn returns a Conn whose Decoder is configured by the local SETTINGS,
+// and whose Encoder by the peer's SETTINGS. The Encoder sets the dynamic
+// table capacity to the peer's maximum with a Set Dynamic Table Capacity
+// instruction. Options apply to both, though may not override the SETTINGS.
+func NewConn(local, peer Settings, opts ...Option) *Conn {
+	opts = opts[:len(opts):len(opts)]
+	return &Conn{
+		encoder: NewEncoder(append(opts, peer.options()...)...),
+		decoder: NewDecoder(append(opts, local.options()...)...),
+		local:   local,
+		peer:    peer,
+	}
+}
+
+// Encoder returns the Encoder of the connection, whose instructions are
+// written to the local encoder stream.
+func (c *Conn) Encoder() *Encoder { return c.encoder }
+
+// Decoder returns the Decoder of the connection, whose instructions are
+// written to the local decoder stream.
+func (c *Conn) Decoder() *Decoder { return c.decoder }
+
+// EncodeHeaders appends the field section of header for stream streamID to
+// p. Pseudo-header fields are included in header by their lower case names,
+// :status for a response, otherwise :method, :scheme, :authority and :path
+// for a request. Extended CONNECT requests include :protocol, which requires
+// the peer's SETTINGS to enable the extended CONNECT protocol.
+func (c *Conn) EncodeHeaders(p []byte, streamID uint64, header map[string][]string) ([]byte, error) {
+	var method, protocol, scheme, authority, path, status string
+
+	fields := make(map[string][]string, len(header))
+	for name, values := range header {
+		if !strings.HasPrefix(name, ":") {
+			fields[name] = values
+			continue
+		}
+		if len(values) != 1 {
+			return p, fmt.Errorf("pseudo-header field %s requires a single value", name)
+		}
+		switch name {
+		case ":method":
+			method = values[0]
+		case ":protocol":
+			protocol = values[0]
+		case ":scheme":
+			scheme = values[0]
+		case ":authority":
+			authority = values[0]
+		case ":path":
+			path = values[0]
+		case ":status":
+			status = values[0]
+		default:
+			return p, fmt.Errorf("unknown pseudo-header field %s", name)
+		}
+	}
+	switch {
+	case status != "":
+		if method != "" || protocol != "" || scheme != "" || authority != "" || path != "" {
+			return p, errors.New("request pseudo-header fields in response")
+		}
+		statusCode, ok := parseStatus(status)
+		if !ok {
+			return p, fmt.Errorf("invalid :status %q", status)
+		}
+		return c.encoder.AppendResponse(p, streamID, statusCode, fields)
+	case protocol != "":
+		if method != "CONNECT" {
+			return p, errors.New(":protocol in a non CONNECT request")
+		}
+		if !c.peer.EnableConnectProtocol {
+			return p, errConnectProtocolDisabled
+		}
+		return c.encoder.AppendExtendedConnect(p, streamID, protocol, scheme, authority, path, fields)
+	case method == "CONNECT":
+		// The :scheme and :path pseudo-header fields MUST be omitted.
+		// https://www.rfc-editor.org/rfc/rfc9114.html#name-the-connect-method
+		if scheme != "" || path != "" {
+			return p, errors.New(":scheme or :path in a CONNECT request")
+		}
+		return c.encoder.AppendConnect(p, streamID, authority, fields)
+	case method != "":
+		return c.encoder.AppendRequest(p, streamID, method, scheme, authority, path, fields)
+	}
+	return p, errors.New("missing :method or :status pseudo-header field")
+}
+
+// parseStatus parses a :status value, three ASCII digits from 100 to 599.
+// https://www.rfc-editor.org/rfc/rfc9110.html#name-status-codes
+func parseStatus(status string) (int, bool) {
+	if len(status) != 3 {
+		return 0, false
+	}
+	var statusCode int
+	for i := 0; i < len(status); i++ {
+		c := status[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		statusCode = 10*statusCode + int(c-'0')
+	}
+	return statusCode, 100 <= statusCode && statusCode <= 599
+}
+
+// DecodeHeaders decodes the field section in, received on stream streamID,
+// as Decoder.Decode. Unless the local SETTINGS enable the extended CONNECT
+// protocol, a :protocol pseudo-header field is withheld from accept, and the
+// field section reported as malformed with ErrMessage.
+func (c *Conn) DecodeHeaders(streamID uint64, in []byte, accept func(name, value string), done func(error)) error {
+	if c.local.EnableConnectProtocol {
+		return c.decoder.Decode(streamID, in, accept, done)
+	}
+	var malformed error
+	finish := func(err error) error {
+		if err != nil {
+			return err
+		}
+		return malformed
+	}
+	next := accept
+	accept = func(name, value string) {
+		if name == ":protocol" {
+			malformed = ErrMessage{errConnectProtocolDisabled}
+			return
+		}
+		next(name, value)
+	}
+	if done != nil {
+		next := done
+		done = func(err error) { next(finish(err)) }
+	}
+	err := c.decoder.Decode(streamID, in, accept, done)
+	if err == ErrBlocked {
+		return err
+	}
+	return finish(err)
+}
+
+// CancelStream discards the state of stream streamID, as Decoder.CancelStream.
+func (c *Conn) CancelStream(streamID uint64) {
+	c.decoder.CancelStream(streamID)
+}
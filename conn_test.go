@@ -0,0 +1,165 @@
+package quack
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	clientSettings := Settings{MaxTableCapacity: 4096, BlockedStreams: 16}
+	serverSettings := Settings{MaxTableCapacity: 1024, BlockedStreams: 8}
+
+	client := NewConn(clientSettings, serverSettings)
+	server := NewConn(serverSettings, clientSettings)
+
+	if client.Encoder().maxTableCapacity != 1024 || client.Encoder().maxBlockedStreams != 8 {
+		t.Fatalf("client encoder not configured by server settings")
+	}
+	if client.Decoder().maxTableCapacity != 4096 || client.Decoder().maxBlockedStreams != 16 {
+		t.Fatalf("client decoder not configured by client settings")
+	}
+
+	// Set Dynamic Table Capacity (1024)
+	instructions := client.Encoder().AppendEncoderInstructions(nil)
+	if got, want := instructions, dehex(t, "3fe107"); string(got) != string(want) {
+		t.Fatalf("expected set dynamic table capacity %x, got %x", want, got)
+	}
+	if err := server.Decoder().ParseEncoderInstructions(instructions); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	roundTrip := func(from, to *Conn, streamID uint64, header map[string][]string) []headerField {
+		t.Helper()
+		p, err := from.EncodeHeaders(nil, streamID, header)
+		if err != nil {
+			t.Fatalf("unexpected encode error %v", err)
+		}
+		err = to.Decoder().ParseEncoderInstructions(from.Encoder().AppendEncoderInstructions(nil))
+		if err != nil {
+			t.Fatalf("unexpected encoder instructions error %v", err)
+		}
+		var fields []headerField
+		accept := func(name, value string) {
+			fields = append(fields, headerField{name, value})
+		}
+		if err := to.DecodeHeaders(streamID, p, accept, nil); err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+		err = from.Encoder().ParseDecoderInstructions(to.Decoder().AppendDecoderInstructions(nil))
+		if err != nil {
+			t.Fatalf("unexpected decoder instructions error %v", err)
+		}
+		return fields
+	}
+
+	fields := roundTrip(client, server, 0, map[string][]string{
+		":method":    {"GET"},
+		":scheme":    {"https"},
+		":authority": {"example.com"},
+		":path":      {"/index.html"},
+		"X-Custom":   {"value"},
+	})
+	expected := []headerField{
+		{":method", "GET"},
+		{":scheme", "https"},
+		{":authority", "example.com"},
+		{":path", "/index.html"},
+		{"X-Custom", "value"},
+	}
+	if len(fields) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, fields)
+	}
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], fields[i])
+		}
+	}
+	if len(client.Encoder().streams) != 0 {
+		t.Errorf("expected field section to be acknowledged")
+	}
+
+	fields = roundTrip(server, client, 0, map[string][]string{
+		":status":  {"200"},
+		"Date":     {"Mon, 02 Jan 2006 15:04:05 GMT"},
+		"X-Custom": {"value"},
+	})
+	if len(fields) != 3 || fields[0] != (headerField{":status", "200"}) {
+		t.Fatalf("unexpected response fields %v", fields)
+	}
+}
+
+func TestConnEncodeHeaders(t *testing.T) {
+	c := NewConn(Settings{}, Settings{})
+
+	tests := []struct {
+		name   string
+		header map[string][]string
+		ok     bool
+	}{
+		{"empty", map[string][]string{}, false},
+		{"response with request fields", map[string][]string{":status": {"200"}, ":method": {"GET"}}, false},
+		{"multiple values", map[string][]string{":method": {"GET", "POST"}}, false},
+		{"protocol without connect", map[string][]string{":protocol": {"websocket"}}, false},
+		{"status 100", map[string][]string{":status": {"100"}}, true},
+		{"status 599", map[string][]string{":status": {"599"}}, true},
+		{"status four digits", map[string][]string{":status": {"2000"}}, false},
+		{"status plus sign", map[string][]string{":status": {"+20"}}, false},
+		{"status negative", map[string][]string{":status": {"-99"}}, false},
+		{"status below 100", map[string][]string{":status": {"099"}}, false},
+		{"status above 599", map[string][]string{":status": {"600"}}, false},
+		{"status not digits", map[string][]string{":status": {"2x0"}}, false},
+		{"connect", map[string][]string{":method": {"CONNECT"}, ":authority": {"example.com:443"}}, true},
+		{"connect with scheme", map[string][]string{":method": {"CONNECT"}, ":scheme": {"https"}, ":authority": {"example.com:443"}}, false},
+		{"connect with path", map[string][]string{":method": {"CONNECT"}, ":authority": {"example.com:443"}, ":path": {"/"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.EncodeHeaders(nil, 4, tt.header)
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("expected ok %t, got error %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestConnEnableConnectProtocol(t *testing.T) {
+	header := map[string][]string{
+		":method":    {"CONNECT"},
+		":protocol":  {"websocket"},
+		":scheme":    {"https"},
+		":authority": {"example.com"},
+		":path":      {"/chat"},
+	}
+	enabled := Settings{EnableConnectProtocol: true}
+
+	// Encoding requires the peer to enable extended CONNECT.
+	if _, err := NewConn(enabled, Settings{}).EncodeHeaders(nil, 0, header); err == nil {
+		t.Errorf("expected error encoding :protocol without peer enabling extended CONNECT")
+	}
+	p, err := NewConn(Settings{}, enabled).EncodeHeaders(nil, 0, header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+
+	// Decoding requires the local endpoint to enable extended CONNECT.
+	var protocol string
+	accept := func(name, value string) {
+		if name == ":protocol" {
+			protocol = value
+		}
+	}
+	if err := NewConn(enabled, Settings{}).DecodeHeaders(0, p, accept, nil); err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if protocol != "websocket" {
+		t.Errorf("expected :protocol websocket, got %q", protocol)
+	}
+	protocol = ""
+	var me ErrMessage
+	if err := NewConn(Settings{}, enabled).DecodeHeaders(0, p, accept, nil); !errors.As(err, &me) {
+		t.Errorf("expected message error decoding :protocol without extended CONNECT enabled, got %v", err)
+	}
+	if protocol != "" {
+		t.Errorf("expected :protocol withheld, got %q", protocol)
+	}
+}
@@ -1,31 +1,319 @@
 package quack
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 
 	"github.com/renthraysk/quack/internal/field"
+	"github.com/renthraysk/quack/internal/inst"
 )
 
+var (
+	errTooManyBlockedStreams = errors.New("too many blocked streams")
+	errInstructionTooLong    = errors.New("instruction too long")
+)
+
+// blockedSection is a field section awaiting dynamic table inserts.
+type blockedSection struct {
+	streamID       uint64
+	reqInsertCount uint64
+	in             []byte
+	accept         func(Field)
+	done           func(error)
+}
+
 type Decoder struct {
 	dt           field.DT
 	fieldDecoder atomic.Pointer[field.Decoder]
+
+	maxTableCapacity  uint64
+	maxBlockedStreams uint64
+	// maxFieldSectionSize is the limit on the size of decoded field
+	// sections, math.MaxUint64 if unlimited.
+	maxFieldSectionSize uint64
+	// strict rejects connection-specific fields.
+	strict bool
+
+	// numBlocked is the length of blocked, for DecodeFields to check without
+	// taking mu.
+	numBlocked atomic.Int64
+
+	// mu guards the fields below, and serialises updates of fieldDecoder.
+	mu      sync.Mutex
+	blocked []blockedSection
+	// knownReceivedCount is the insert count the peer's encoder knows the
+	// decoder has received, via acknowledgements & increments sent.
+	knownReceivedCount uint64
+	// instructions are the pending decoder stream instructions, excluding
+	// the Insert Count Increment which is coalesced.
+	instructions []byte
+	// partial holds a trailing incomplete encoder stream instruction.
+	partial []byte
+
+	// pending is signalled when decoder instructions become pending.
+	pending chan struct{}
+}
+
+func NewDecoder(opts ...Option) *Decoder {
+	o := newOptions(opts)
+
+	d := &Decoder{
+		maxTableCapacity:    o.maxTableCapacity,
+		maxBlockedStreams:   o.maxBlockedStreams,
+		maxFieldSectionSize: o.fieldSectionSizeLimit(),
+		strict:              o.strict,
+		pending:             make(chan struct{}, 1),
+	}
+	if o.strict {
+		d.dt.SetStrict()
+	}
+	d.dt.SetMaxCapacity(o.maxTableCapacity)
+	d.fieldDecoder.Store(d.dt.Decoder())
+	return d
+}
+
+// Decode decodes the field section in, received on stream streamID, calling
+// accept for each field line. If the field section references dynamic table
+// entries yet to arrive on the encoder stream, a copy is held as blocked and
+// Decode returns ErrBlocked. Once ParseEncoderInstructions has received the
+// entries the held section is decoded, and the outcome passed to done. Later
+// field sections of the stream are held behind a blocked section, so are
+// decoded, and acknowledged, in order. If
+// done is nil the field section is not held, and may be decoded again once
+// more entries have been received.
+// Decoding stops with ErrFieldSectionTooLarge if the field section exceeds
+// MaxFieldSectionSize, in which case the stream should be cancelled with
+// CancelStream.
+func (d *Decoder) Decode(streamID uint64, in []byte, accept func(name, value string), done func(error)) error {
+	return d.DecodeFields(streamID, in, func(f Field) { accept(f.Name, f.Value) }, done)
+}
+
+// DecodeFields is Decode, passing each field with the never-index bit of its
+// field line, for intermediaries to preserve when re-encoding.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-never-indexed-literals
+func (d *Decoder) DecodeFields(streamID uint64, in []byte, accept func(Field), done func(error)) error {
+	if d.numBlocked.Load() == 0 {
+		fd := d.fieldDecoder.Load()
+		if err := d.decode(fd, streamID, in, accept); err != field.ErrBlocked {
+			return decompressionFailed(err)
+		}
+	}
+	return d.block(streamID, in, accept, done)
+}
+
+// decode decodes field section in with fd, acknowledging the section if it
+// references the dynamic table. If strict, connection-specific fields are
+// withheld from accept, and the field section reported as malformed once
+// decoded.
+func (d *Decoder) decode(fd *field.Decoder, streamID uint64, in []byte, accept func(Field)) error {
+	var malformed error
+	if d.strict {
+		next := accept
+		accept = func(f Field) {
+			if isConnectionSpecific(f.Name, f.Value) {
+				if malformed == nil {
+					malformed = fmt.Errorf("%w: connection-specific field %s", field.ErrMalformed, f.Name)
+				}
+				return
+			}
+			next(f)
+		}
+	}
+	if err := fd.Decode(in, d.maxFieldSectionSize, accept); err != nil {
+		return err
+	}
+	reqInsertCount, err := fd.RequiredInsertCount(in)
+	if err != nil {
+		return err
+	}
+	if reqInsertCount > 0 {
+		d.mu.Lock()
+		d.acknowledgeLocked(streamID, reqInsertCount)
+		d.mu.Unlock()
+	}
+	return malformed
+}
+
+// acknowledgeLocked queues a Section Acknowledgment for a field section with
+// a Required Insert Count of reqInsertCount decoded on stream streamID.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-section-acknowledgment
+func (d *Decoder) acknowledgeLocked(streamID, reqInsertCount uint64) {
+	d.instructions = inst.AppendSectionAcknowledgement(d.instructions, streamID)
+	d.knownReceivedCount = max(d.knownReceivedCount, reqInsertCount)
+	signal(d.pending)
+}
+
+// CancelStream discards any blocked field sections of stream streamID, and
+// informs the peer's encoder of the cancellation. Should be called when a
+// stream is reset, or abandoned before all its field sections are decoded.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-stream-cancellation
+func (d *Decoder) CancelStream(streamID uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	blocked := d.blocked[:0]
+	for _, b := range d.blocked {
+		if b.streamID != streamID {
+			blocked = append(blocked, b)
+		}
+	}
+	clear(d.blocked[len(blocked):])
+	d.blocked = blocked
+	d.numBlocked.Store(int64(len(blocked)))
+
+	// A decoder with a maximum dynamic table capacity of zero MAY omit
+	// sending Stream Cancellations.
+	if d.maxTableCapacity > 0 {
+		d.instructions = inst.AppendStreamCancellation(d.instructions, streamID)
+		signal(d.pending)
+	}
 }
 
-func NewDecoder() *Decoder {
-	return &Decoder{}
+// AppendDecoderInstructions appends the pending decoder stream instructions
+// to p, for sending to the peer's encoder. Insert Count Increments are
+// coalesced into a single instruction covering all inserts received.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-decoder-instructions
+func (d *Decoder) AppendDecoderInstructions(p []byte) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p = append(p, d.instructions...)
+	d.instructions = d.instructions[:0]
+
+	insertCount := d.fieldDecoder.Load().InsertCount()
+	if insertCount > d.knownReceivedCount {
+		p = inst.AppendInsertCountIncrement(p, insertCount-d.knownReceivedCount)
+		d.knownReceivedCount = insertCount
+	}
+	return p
 }
 
-func (d *Decoder) Decode(in []byte, accept func(name, value string)) error {
+// block holds field section in until the dynamic table has received the
+// inserts it requires, and any blocked field sections of the stream have been
+// decoded.
+func (d *Decoder) block(streamID uint64, in []byte, accept func(Field), done func(error)) error {
+	d.mu.Lock()
+	// The encoder stream may have progressed since Decode loaded fieldDecoder.
 	fd := d.fieldDecoder.Load()
-	if err := fd.Decode(in, accept); err != nil {
+	reqInsertCount, err := fd.RequiredInsertCount(in)
+	if err != nil {
+		d.mu.Unlock()
 		return ErrDecompressionFailed{err}
 	}
-	return nil
+	if reqInsertCount <= fd.InsertCount() && !isBlocked(d.blocked, streamID) {
+		d.mu.Unlock()
+		return decompressionFailed(d.decode(fd, streamID, in, accept))
+	}
+	if done == nil {
+		d.mu.Unlock()
+		return ErrBlocked
+	}
+	if !isBlocked(d.blocked, streamID) && d.blockedStreamsLocked() >= d.maxBlockedStreams {
+		d.mu.Unlock()
+		return ErrDecompressionFailed{errTooManyBlockedStreams}
+	}
+	d.blocked = append(d.blocked, blockedSection{
+		streamID:       streamID,
+		reqInsertCount: reqInsertCount,
+		in:             append([]byte(nil), in...),
+		accept:         accept,
+		done:           done,
+	})
+	d.numBlocked.Store(int64(len(d.blocked)))
+	d.mu.Unlock()
+	return ErrBlocked
 }
 
+// blockedStreamsLocked returns the number of distinct streams with blocked
+// field sections.
+func (d *Decoder) blockedStreamsLocked() uint64 {
+	var n uint64
+	for i, b := range d.blocked {
+		if !isBlocked(d.blocked[:i], b.streamID) {
+			n++
+		}
+	}
+	return n
+}
+
+// isBlocked returns true if any of blocked belong to stream streamID.
+func isBlocked(blocked []blockedSection, streamID uint64) bool {
+	for _, b := range blocked {
+		if b.streamID == streamID {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEncoderInstructions parses the instructions received on the peer's
+// encoder stream. Instructions may be split across calls at any byte
+// boundary, an incomplete instruction is retained until the remainder
+// arrives.
 func (d *Decoder) ParseEncoderInstructions(in []byte) error {
-	if err := d.dt.DecodeEncoderInstructions(in); err != nil {
+	d.mu.Lock()
+	if len(d.partial) > 0 {
+		in = append(d.partial, in...)
+	}
+	rest, err := d.dt.DecodeEncoderInstructions(in)
+	if err == nil && uint64(len(rest)) > maxInstructionLength(d.maxTableCapacity) {
+		err = errInstructionTooLong
+	}
+	if err != nil {
+		d.mu.Unlock()
 		return ErrEncoderStream{err}
 	}
+	d.partial = append(d.partial[:0], rest...)
+	fd := d.dt.Decoder()
+	if fd.InsertCount() > d.fieldDecoder.Load().InsertCount() {
+		// Insert Count Increment required.
+		signal(d.pending)
+	}
+	d.fieldDecoder.Store(fd)
+
+	// Release the field sections that are no longer blocked, nor behind a
+	// blocked section of the same stream, preserving the order of those that
+	// remain.
+	var unblocked []blockedSection
+	blocked := d.blocked[:0]
+	for _, b := range d.blocked {
+		if b.reqInsertCount <= fd.InsertCount() && !isBlocked(blocked, b.streamID) {
+			unblocked = append(unblocked, b)
+			continue
+		}
+		blocked = append(blocked, b)
+	}
+	clear(d.blocked[len(blocked):])
+	d.blocked = blocked
+	d.numBlocked.Store(int64(len(blocked)))
+	d.mu.Unlock()
+
+	for _, b := range unblocked {
+		b.done(decompressionFailed(d.decode(fd, b.streamID, b.in, b.accept)))
+	}
 	return nil
 }
+
+// maxInstructionLength returns the length beyond which an incomplete encoder
+// instruction can not be an insert that fits within a dynamic table of
+// maxCapacity. Allows for the worst case expansion of Huffman encoding, 30
+// bits per octet.
+func maxInstructionLength(maxCapacity uint64) uint64 {
+	return 4*maxCapacity + 32
+}
+
+// decompressionFailed wraps a non nil err from decoding a field section.
+func decompressionFailed(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case field.ErrFieldSectionTooLarge:
+		return ErrFieldSectionTooLarge
+	}
+	if errors.Is(err, field.ErrMalformed) {
+		return ErrMessage{err}
+	}
+	return ErrDecompressionFailed{err}
+}
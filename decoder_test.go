@@ -0,0 +1,296 @@
+package quack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"testing"
+)
+
+type headerField struct {
+	name, value string
+}
+
+func TestDecoderBlockedStreams(t *testing.T) {
+
+	d := NewDecoder(MaxTableCapacity(220), MaxBlockedStreams(1))
+
+	var got []headerField
+	var doneErr error
+	var doneCalled bool
+
+	accept := func(name, value string) { got = append(got, headerField{name, value}) }
+	done := func(err error) {
+		doneCalled = true
+		doneErr = err
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-2
+	err := d.Decode(4, dehex(t, "03811011"), accept, done)
+	if !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+	// A second section on the same stream does not count against the limit.
+	err = d.Decode(4, dehex(t, "03811011"), func(string, string) {}, func(error) {})
+	if !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+	// Another blocked stream exceeds SETTINGS_QPACK_BLOCKED_STREAMS.
+	err = d.Decode(8, dehex(t, "03811011"), accept, done)
+	var df ErrDecompressionFailed
+	if !errors.As(err, &df) {
+		t.Fatalf("expected ErrDecompressionFailed, got %v", err)
+	}
+
+	err = d.ParseEncoderInstructions(dehex(t, "3fbd01c00f7777772e6578616d706c652e636f6dc10c2f73616d706c652f70617468"))
+	if err != nil {
+		t.Fatalf("unexpected encoder stream error %v", err)
+	}
+	if !doneCalled {
+		t.Fatal("expected blocked section to be decoded")
+	}
+	if doneErr != nil {
+		t.Fatalf("unexpected decode error %v", doneErr)
+	}
+	exp := []headerField{{":authority", "www.example.com"}, {":path", "/sample/path"}}
+	if len(got) != len(exp) || got[0] != exp[0] || got[1] != exp[1] {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+	if len(d.blocked) != 0 {
+		t.Errorf("expected no blocked sections, got %d", len(d.blocked))
+	}
+
+	// No longer blocked, so decodes immediately.
+	got = got[:0]
+	if err := d.Decode(8, dehex(t, "03811011"), accept, done); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(got) != len(exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+}
+
+func TestDecoderBlockedOrder(t *testing.T) {
+
+	d := NewDecoder(MaxTableCapacity(220), MaxBlockedStreams(1))
+
+	// Insert :authority=www.example.com only.
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-2
+	if err := d.ParseEncoderInstructions(dehex(t, "3fbd01c00f7777772e6578616d706c652e636f6d")); err != nil {
+		t.Fatalf("unexpected encoder stream error %v", err)
+	}
+
+	var got []string
+	section := func(name string) (func(string, string), func(error)) {
+		accept := func(string, string) {}
+		done := func(err error) {
+			if err != nil {
+				t.Errorf("unexpected decode error %v", err)
+			}
+			got = append(got, name)
+		}
+		return accept, done
+	}
+	for _, s := range []struct {
+		name, in string
+	}{
+		// Requires the yet to be inserted :path.
+		{"blocked", "03811011"},
+		// Requires only :authority, already inserted.
+		{"dynamic", "020080"},
+		// Static table only, :method GET.
+		{"static", "0000d1"},
+	} {
+		accept, done := section(s.name)
+		if err := d.Decode(4, dehex(t, s.in), accept, done); !errors.Is(err, ErrBlocked) {
+			t.Fatalf("expected %s section ErrBlocked, got %v", s.name, err)
+		}
+	}
+	if len(d.instructions) != 0 {
+		t.Fatalf("expected no Section Acknowledgements while blocked, got %x", d.instructions)
+	}
+
+	// Another stream is unaffected.
+	if err := d.Decode(8, dehex(t, "020080"), func(string, string) {}, nil); err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	d.instructions = d.instructions[:0]
+
+	// Insert :path=/sample/path.
+	if err := d.ParseEncoderInstructions(dehex(t, "c10c2f73616d706c652f70617468")); err != nil {
+		t.Fatalf("unexpected encoder stream error %v", err)
+	}
+	if exp := []string{"blocked", "dynamic", "static"}; !slices.Equal(got, exp) {
+		t.Errorf("expected sections decoded in order %v, got %v", exp, got)
+	}
+	// Section Acknowledgements of stream 4, in order.
+	if exp := dehex(t, "8484"); !bytes.Equal(d.instructions, exp) {
+		t.Errorf("expected decoder instructions %x, got %x", exp, d.instructions)
+	}
+}
+
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-encoding-and-decoding-exam
+func TestDecoderInstructions(t *testing.T) {
+
+	d := NewDecoder(MaxTableCapacity(220))
+
+	decode := func(streamID uint64, s string) {
+		t.Helper()
+		err := d.Decode(streamID, dehex(t, s), func(string, string) {}, nil)
+		if err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+	}
+	parse := func(s string) {
+		t.Helper()
+		if err := d.ParseEncoderInstructions(dehex(t, s)); err != nil {
+			t.Fatalf("unexpected encoder stream error %v", err)
+		}
+	}
+	expect := func(s string) {
+		t.Helper()
+		if got := hex.EncodeToString(d.AppendDecoderInstructions(nil)); got != s {
+			t.Errorf("expected decoder instructions %q, got %q", s, got)
+		}
+	}
+
+	// Static only field sections are not acknowledged.
+	decode(0, "0000510b2f696e6465782e68746d6c")
+	expect("")
+
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-2
+	parse("3fbd01c00f7777772e6578616d706c652e636f6dc10c2f73616d706c652f70617468")
+	decode(4, "03811011")
+	expect("84")
+
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-speculative-insert
+	parse("4a637573746f6d2d6b65790c637573746f6d2d76616c7565")
+	expect("01")
+
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-duplicate-instruction-strea
+	parse("02")
+	decode(8, "050080c181")
+	d.CancelStream(8)
+	expect("8848")
+
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-insert-evicti
+	parse("810d637573746f6d2d76616c756532")
+	expect("01")
+	expect("")
+}
+
+func dehex(tb testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		tb.Fatalf("failed to decode hex")
+	}
+	return b
+}
+
+func TestDecoderFragmentedEncoderStream(t *testing.T) {
+
+	d := NewDecoder(MaxTableCapacity(220), MaxBlockedStreams(1))
+
+	var got []headerField
+	var doneErr error
+	var doneCalled bool
+
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-2
+	err := d.Decode(4, dehex(t, "03811011"), func(name, value string) {
+		got = append(got, headerField{name, value})
+	}, func(err error) {
+		doneCalled = true
+		doneErr = err
+	})
+	if !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+
+	in := dehex(t, "3fbd01c00f7777772e6578616d706c652e636f6dc10c2f73616d706c652f70617468")
+	for i := range in {
+		if err := d.ParseEncoderInstructions(in[i : i+1]); err != nil {
+			t.Fatalf("unexpected encoder stream error at %d: %v", i, err)
+		}
+	}
+	if !doneCalled || doneErr != nil {
+		t.Fatalf("expected blocked section to be decoded, got %v", doneErr)
+	}
+	if len(got) != 2 {
+		t.Errorf("expected 2 fields, got %v", got)
+	}
+
+	// Duplicate of a non-existent entry.
+	var es ErrEncoderStream
+	if err := d.ParseEncoderInstructions([]byte{0x1F}); err != nil {
+		t.Fatalf("unexpected error for incomplete instruction %v", err)
+	}
+	if err := d.ParseEncoderInstructions([]byte{0x10}); !errors.As(err, &es) {
+		t.Errorf("expected ErrEncoderStream, got %v", err)
+	}
+}
+
+func TestDecoderNilDone(t *testing.T) {
+	d := NewDecoder(MaxTableCapacity(220), MaxBlockedStreams(1))
+	section := dehex(t, "03811011")
+
+	// Not held, so the blocked streams limit is not consumed.
+	var req Request
+	if err := d.DecodeRequest(4, section, &req, func(string, string) {}, nil); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+	if err := d.Decode(8, section, func(string, string) {}, nil); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+	if len(d.blocked) != 0 {
+		t.Fatalf("expected no blocked sections held, got %d", len(d.blocked))
+	}
+	in := dehex(t, "3fbd01c00f7777772e6578616d706c652e636f6dc10c2f73616d706c652f70617468")
+	if err := d.ParseEncoderInstructions(in); err != nil {
+		t.Fatalf("unexpected encoder stream error %v", err)
+	}
+	var got []headerField
+	err := d.Decode(4, section, func(name, value string) {
+		got = append(got, headerField{name, value})
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("expected 2 fields, got %v", got)
+	}
+}
+
+func TestMaxFieldSectionSize(t *testing.T) {
+	header := map[string][]string{"X-Custom": {"value"}}
+	// :method GET, :scheme https, :authority example.com, :path /, X-Custom value
+	size := uint64(7+3+32) + (7 + 5 + 32) + (10 + 11 + 32) + (5 + 1 + 32) + (8 + 5 + 32)
+
+	p, err := NewEncoder().AppendRequest(nil, 0, "GET", "https", "example.com", "/", header)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, limit := range []uint64{size - 1, size, size + 1} {
+		e := NewEncoder(MaxFieldSectionSize(limit))
+		_, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/", header)
+		if limit < size && err != ErrFieldSectionTooLarge {
+			t.Errorf("expected encoder limit %d to be exceeded, got %v", limit, err)
+		} else if limit >= size && err != nil {
+			t.Errorf("unexpected encoder error with limit %d, %v", limit, err)
+		}
+
+		d := NewDecoder(MaxFieldSectionSize(limit))
+		var n int
+		err = d.Decode(0, p, func(string, string) { n++ }, nil)
+		if limit < size {
+			if err != ErrFieldSectionTooLarge {
+				t.Errorf("expected decoder limit %d to be exceeded, got %v", limit, err)
+			}
+			if n != 4 {
+				t.Errorf("expected decoding to stop at the last field line, got %d", n)
+			}
+		} else if err != nil {
+			t.Errorf("unexpected decoder error with limit %d, %v", limit, err)
+		}
+	}
+}
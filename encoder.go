@@ -2,6 +2,10 @@ package quack
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/renthraysk/quack/ascii"
@@ -15,26 +19,100 @@ type Encoder struct {
 
 	// fieldEncoder is the encoder state required to encode headers.
 	// It is immutable once created by the dynamic table.
-	// If nil then will only encode using the static table. Will be updated
-	// when receive the increment decoder instruction from peer.
+	// If nil then will only encode using the static table, and the default
+	// sensitivity. Will be replaced whenever the dynamic table changes.
 	fieldEncoder atomic.Pointer[field.Encoder]
+
+	maxTableCapacity  uint64
+	maxBlockedStreams uint64
+	nonBlocking       bool
+	sortedFields      bool
+	strict            bool
+	// maxFieldSectionSize is the peer's limit on the size of field
+	// sections, math.MaxUint64 if unlimited.
+	maxFieldSectionSize uint64
+
+	// mu guards the fields below, and serialises changes to the dynamic
+	// table.
+	mu sync.Mutex
+	// streams holds the streams with unacknowledged field sections.
+	streams map[uint64]*stream
+	// instructions are the pending encoder stream instructions.
+	instructions []byte
+	// partial holds a trailing incomplete decoder stream instruction.
+	partial []byte
+
+	// pending is signalled when instructions are appended.
+	pending chan struct{}
 }
 
-func NewEncoder() *Encoder {
-	return &Encoder{}
+var errUnexpectedAcknowledgement = errors.New("section acknowledgement for stream without unacknowledged sections")
+
+// NewEncoder returns an Encoder configured with the peer's QPACK settings.
+// Unless a MaxTableCapacity option is supplied, encodes with only the static
+// table.
+func NewEncoder(opts ...Option) *Encoder {
+	o := newOptions(opts)
+
+	e := &Encoder{
+		maxTableCapacity:    o.maxTableCapacity,
+		maxBlockedStreams:   o.maxBlockedStreams,
+		nonBlocking:         o.nonBlocking || o.maxBlockedStreams == 0,
+		sortedFields:        o.sortedFields,
+		strict:              o.strict,
+		maxFieldSectionSize: o.fieldSectionSizeLimit(),
+		streams:             make(map[uint64]*stream),
+		pending:             make(chan struct{}, 1),
+	}
+	e.dt.SetPolicy(o.sensitivity)
+	e.dt.SetInsertLimits(o.insertLimits)
+	if o.maxTableCapacity > 0 {
+		e.dt.SetMaxCapacity(o.maxTableCapacity)
+		e.instructions, _ = e.dt.AppendSetCapacity(e.instructions, o.maxTableCapacity)
+		e.fieldEncoder.Store(e.dt.Encoder())
+		signal(e.pending)
+	} else if o.sensitivity != nil {
+		// Static table only, but encoded with the sensitivity given.
+		e.fieldEncoder.Store(e.dt.Encoder())
+	}
+	return e
 }
 
-func allEqual[T comparable](s []T, one T) bool {
-	for _, v := range s {
-		if v != one {
-			return false
+// Field is a name value pair of a field section.
+type Field = field.Field
+
+// allEqual reports whether every value of field name in header is one.
+func allEqual(header field.Header, name, one string) bool {
+	equal := true
+	header.Fields(func(f Field) {
+		if f.Name == name && f.Value != one {
+			equal = false
 		}
+	})
+	return equal
+}
+
+// header returns the Header of a map, sorted if the SortedFields option was
+// supplied.
+func (e *Encoder) header(header map[string][]string) field.Header {
+	if e.sortedFields {
+		return field.NewSortedMap(header)
 	}
-	return true
+	return field.Map(header)
 }
 
 // AppendRequest https://www.rfc-editor.org/rfc/rfc9114.html#name-request-pseudo-header-field
-func (e *Encoder) AppendRequest(p []byte, method, scheme, authority, path string, header map[string][]string) ([]byte, error) {
+func (e *Encoder) AppendRequest(p []byte, streamID uint64, method, scheme, authority, path string, header map[string][]string) ([]byte, error) {
+	return e.appendRequest(p, streamID, method, scheme, authority, path, e.header(header))
+}
+
+// AppendRequestFields is AppendRequest with fields encoded in the order
+// given.
+func (e *Encoder) AppendRequestFields(p []byte, streamID uint64, method, scheme, authority, path string, fields []Field) ([]byte, error) {
+	return e.appendRequest(p, streamID, method, scheme, authority, path, field.List(fields))
+}
+
+func (e *Encoder) appendRequest(p []byte, streamID uint64, method, scheme, authority, path string, header field.Header) ([]byte, error) {
 
 	if len(scheme) <= len("https") {
 		switch ascii.Lower(scheme) {
@@ -43,7 +121,7 @@ func (e *Encoder) AppendRequest(p []byte, method, scheme, authority, path string
 			// :authority pseudo-header field instead of the Host header field.
 			if authority == "" {
 				return p, errors.New("empty :authority")
-			} else if hosts, ok := header["Host"]; ok && !allEqual(hosts, authority) {
+			} else if !allEqual(header, "Host", authority) {
 				return p, errors.New(":authority and Host header are inconsistent")
 			}
 			// This pseudo-header field MUST NOT be empty for "http" or "https" URIs;
@@ -60,65 +138,434 @@ func (e *Encoder) AppendRequest(p []byte, method, scheme, authority, path string
 		}
 	}
 
-	fe := e.fieldEncoder.Load()
-	p = fe.AppendRequest(p, method, scheme, authority, path, header)
+	if err := e.checkFields(header, method, scheme, authority, path); err != nil {
+		return p, err
+	}
+	size := fieldSize(":method", method) + fieldSize(":scheme", scheme) +
+		fieldSize(":authority", authority) + fieldSize(":path", path)
+	if err := e.checkFieldSectionSize(size, header); err != nil {
+		return p, err
+	}
+	p = e.appendFieldSection(p, streamID, header, func(p []byte, fe *field.Encoder, s *field.Section) []byte {
+		return fe.AppendRequest(p, s, method, scheme, authority, path, header)
+	})
 	return p, nil
 }
 
 // AppendConnect https://www.rfc-editor.org/rfc/rfc9114.html#name-the-connect-method
-func (e *Encoder) AppendConnect(p []byte, authority string, header map[string][]string) ([]byte, error) {
-	fe := e.fieldEncoder.Load()
-	p = fe.AppendConnect(p, authority, header)
+func (e *Encoder) AppendConnect(p []byte, streamID uint64, authority string, header map[string][]string) ([]byte, error) {
+	return e.appendConnect(p, streamID, authority, e.header(header))
+}
+
+// AppendConnectFields is AppendConnect with fields encoded in the order
+// given.
+func (e *Encoder) AppendConnectFields(p []byte, streamID uint64, authority string, fields []Field) ([]byte, error) {
+	return e.appendConnect(p, streamID, authority, field.List(fields))
+}
+
+func (e *Encoder) appendConnect(p []byte, streamID uint64, authority string, header field.Header) ([]byte, error) {
+	if err := e.checkFields(header, authority); err != nil {
+		return p, err
+	}
+	size := fieldSize(":method", "CONNECT") + fieldSize(":authority", authority)
+	if err := e.checkFieldSectionSize(size, header); err != nil {
+		return p, err
+	}
+	p = e.appendFieldSection(p, streamID, header, func(p []byte, fe *field.Encoder, s *field.Section) []byte {
+		return fe.AppendConnect(p, s, authority, header)
+	})
+	return p, nil
+}
+
+// AppendExtendedConnect encodes an extended CONNECT request, for protocols
+// such as WebSocket, WebTransport and CONNECT-UDP. Headers such as
+// Capsule-Protocol are supplied in header.
+// https://www.rfc-editor.org/rfc/rfc9220.html#name-websockets-upgrade-over-htt
+// https://www.rfc-editor.org/rfc/rfc9298.html#name-http-3-request
+func (e *Encoder) AppendExtendedConnect(p []byte, streamID uint64, protocol, scheme, authority, path string, header map[string][]string) ([]byte, error) {
+	return e.appendExtendedConnect(p, streamID, protocol, scheme, authority, path, e.header(header))
+}
+
+// AppendExtendedConnectFields is AppendExtendedConnect with fields encoded in
+// the order given.
+func (e *Encoder) AppendExtendedConnectFields(p []byte, streamID uint64, protocol, scheme, authority, path string, fields []Field) ([]byte, error) {
+	return e.appendExtendedConnect(p, streamID, protocol, scheme, authority, path, field.List(fields))
+}
+
+func (e *Encoder) appendExtendedConnect(p []byte, streamID uint64, protocol, scheme, authority, path string, header field.Header) ([]byte, error) {
+	// On requests bearing the :protocol pseudo-header field, the :scheme and
+	// :path pseudo-header fields MUST be included.
+	// https://www.rfc-editor.org/rfc/rfc8441.html#section-4
+	switch {
+	case protocol == "":
+		return p, errors.New("empty :protocol")
+	case !ascii.IsNameValid(protocol):
+		return p, errors.New("invalid :protocol")
+	case scheme == "":
+		return p, errors.New("empty :scheme")
+	case authority == "":
+		return p, errors.New("empty :authority")
+	case path == "":
+		return p, errors.New("empty :path")
+	case !allEqual(header, "Host", authority):
+		return p, errors.New(":authority and Host header are inconsistent")
+	}
+	if err := e.checkFields(header, scheme, authority, path); err != nil {
+		return p, err
+	}
+	size := fieldSize(":method", "CONNECT") + fieldSize(":protocol", protocol) +
+		fieldSize(":scheme", scheme) + fieldSize(":authority", authority) + fieldSize(":path", path)
+	if err := e.checkFieldSectionSize(size, header); err != nil {
+		return p, err
+	}
+	p = e.appendFieldSection(p, streamID, header, func(p []byte, fe *field.Encoder, s *field.Section) []byte {
+		return fe.AppendExtendedConnect(p, s, protocol, scheme, authority, path, header)
+	})
 	return p, nil
 }
 
 // AppendResponse https://www.rfc-editor.org/rfc/rfc9114.html#name-response-pseudo-header-fiel
-func (e *Encoder) AppendResponse(p []byte, statusCode int, header map[string][]string) ([]byte, error) {
-	fe := e.fieldEncoder.Load()
-	p = fe.AppendResponse(p, statusCode, header)
+func (e *Encoder) AppendResponse(p []byte, streamID uint64, statusCode int, header map[string][]string) ([]byte, error) {
+	return e.appendResponse(p, streamID, statusCode, e.header(header))
+}
+
+// AppendResponseFields is AppendResponse with fields encoded in the order
+// given.
+func (e *Encoder) AppendResponseFields(p []byte, streamID uint64, statusCode int, fields []Field) ([]byte, error) {
+	return e.appendResponse(p, streamID, statusCode, field.List(fields))
+}
+
+func (e *Encoder) appendResponse(p []byte, streamID uint64, statusCode int, header field.Header) ([]byte, error) {
+	if err := e.checkFields(header); err != nil {
+		return p, err
+	}
+	size := fieldSize(":status", "200") // Three digit status code
+	if !header.Has("Date") && (statusCode < 100 || statusCode >= 200) {
+		size += fieldSize("date", "Mon, 02 Jan 2006 15:04:05 GMT")
+	}
+	if err := e.checkFieldSectionSize(size, header); err != nil {
+		return p, err
+	}
+	p = e.appendFieldSection(p, streamID, header, func(p []byte, fe *field.Encoder, s *field.Section) []byte {
+		return fe.AppendResponse(p, s, statusCode, header)
+	})
 	return p, nil
 }
 
-// readDecoderInstructions https://www.rfc-editor.org/rfc/rfc9204.html#name-decoder-instructions
-func (e *Encoder) readDecoderInstructions(p []byte) error {
-	var streamID, increment uint64
+// AppendTrailers appends the trailer section of header, for stream streamID,
+// to p. Trailers may not contain pseudo-header fields, and unlike
+// AppendResponse no Date field is added.
+func (e *Encoder) AppendTrailers(p []byte, streamID uint64, header map[string][]string) ([]byte, error) {
+	return e.appendTrailers(p, streamID, e.header(header))
+}
+
+// AppendTrailersFields is AppendTrailers with fields encoded in the order
+// given.
+func (e *Encoder) AppendTrailersFields(p []byte, streamID uint64, fields []Field) ([]byte, error) {
+	return e.appendTrailers(p, streamID, field.List(fields))
+}
+
+func (e *Encoder) appendTrailers(p []byte, streamID uint64, header field.Header) ([]byte, error) {
 	var err error
+	header.Fields(func(f Field) {
+		if err == nil && strings.HasPrefix(f.Name, ":") {
+			err = fmt.Errorf("pseudo-header field %s in trailers", f.Name)
+		}
+	})
+	if err != nil {
+		return p, err
+	}
+	if err := e.checkFields(header); err != nil {
+		return p, err
+	}
+	if err := e.checkFieldSectionSize(0, header); err != nil {
+		return p, err
+	}
+	p = e.appendFieldSection(p, streamID, header, func(p []byte, fe *field.Encoder, s *field.Section) []byte {
+		return fe.AppendTrailers(p, s, header)
+	})
+	return p, nil
+}
+
+// checkFields returns an error, if the Strict option was supplied, for any
+// pseudo-header field values, or fields of header, that are malformed or
+// connection-specific.
+func (e *Encoder) checkFields(header field.Header, pseudo ...string) error {
+	if !e.strict {
+		return nil
+	}
+	for _, value := range pseudo {
+		if !ascii.IsValueValid(value) {
+			return fmt.Errorf("invalid pseudo-header field value %q", value)
+		}
+	}
+	var err error
+	header.Fields(func(f Field) {
+		if err == nil {
+			err = checkField(f.Name, f.Value)
+		}
+	})
+	return err
+}
+
+// checkFieldSectionSize returns ErrFieldSectionTooLarge if the field section
+// of the pseudo-header fields of size, and the fields of header, exceeds the
+// peer's maximum field section size.
+func (e *Encoder) checkFieldSectionSize(size uint64, header field.Header) error {
+	if e.maxFieldSectionSize == math.MaxUint64 {
+		return nil
+	}
+	field.EachField(header, func(f Field) {
+		size += fieldSize(f.Name, f.Value)
+	})
+	if size > e.maxFieldSectionSize {
+		return ErrFieldSectionTooLarge
+	}
+	return nil
+}
+
+// fieldSize returns the size of a field.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-header-size-constraints
+func fieldSize(name, value string) uint64 {
+	return uint64(len(name)) + uint64(len(value)) + 32
+}
+
+// appendFieldSection appends the field section for stream streamID, encoded
+// by appendSection, to p. The fields of header are inserted into the dynamic
+// table, and referenced if the peer's blocked streams limit permits.
+func (e *Encoder) appendFieldSection(p []byte, streamID uint64, header field.Header, appendSection func(p []byte, fe *field.Encoder, s *field.Section) []byte) []byte {
+	if e.maxTableCapacity == 0 {
+		return appendSection(p, e.fieldEncoder.Load(), nil)
+	}
+	if e.nonBlocking {
+		return e.appendNonBlockingFieldSection(p, streamID, header, appendSection)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	fe := e.fieldEncoder.Load()
+	if !fe.Indexed(header) {
+		e.appendEncoderInstructionsLocked(header)
+		fe = e.fieldEncoder.Load()
+	}
+
+	s := &field.Section{Limit: e.limitLocked(streamID, fe)}
+	p = appendSection(p, fe, s)
+	if s.RequiredInsertCount > 0 {
+		// Cannot fail, as evictions are serialised by e.mu
+		s.Reference()
+		e.addSectionLocked(streamID, s)
+	}
+	return p
+}
+
+// appendNonBlockingFieldSection appends the field section for stream
+// streamID, encoded by appendSection, to p. Only acknowledged dynamic table
+// entries are referenced, using the current fieldEncoder without
+// synchronising with changes to the dynamic table. The fields of header are
+// then inserted, unless already indexed, or another goroutine is changing the
+// dynamic table.
+func (e *Encoder) appendNonBlockingFieldSection(p []byte, streamID uint64, header field.Header, appendSection func(p []byte, fe *field.Encoder, s *field.Section) []byte) []byte {
+	var fe *field.Encoder
+	for {
+		fe = e.fieldEncoder.Load()
+		s := &field.Section{Limit: fe.KnownReceivedCount()}
+		q := appendSection(p, fe, s)
+		if s.RequiredInsertCount == 0 {
+			p = q
+			break
+		}
+		if s.Reference() {
+			e.mu.Lock()
+			e.addSectionLocked(streamID, s)
+			e.mu.Unlock()
+			p = q
+			break
+		}
+		// An entry was evicted after fe was loaded, so retry with its
+		// replacement.
+	}
+	if !fe.Indexed(header) && e.mu.TryLock() {
+		e.appendEncoderInstructionsLocked(header)
+		e.mu.Unlock()
+	}
+	return p
+}
+
+// appendEncoderInstructionsLocked inserts the fields of header into the
+// dynamic table where possible, queuing the encoder instructions, and
+// replacing fieldEncoder if the dynamic table changed.
+func (e *Encoder) appendEncoderInstructionsLocked(header field.Header) {
+	n := len(e.instructions)
+	var fe *field.Encoder
+	e.instructions, fe = e.dt.AppendEncoderInstructions(e.instructions, header)
+	if fe != e.fieldEncoder.Load() {
+		e.fieldEncoder.Store(fe)
+	}
+	if len(e.instructions) > n {
+		signal(e.pending)
+	}
+}
+
+// limitLocked returns the absolute index from which dynamic table entries may
+// not be referenced by a field section on stream streamID. Referencing
+// entries the peer's decoder is not known to have received may block the
+// stream, so is only permitted within the peer's blocked streams limit.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-blocked-streams
+func (e *Encoder) limitLocked(streamID uint64, fe *field.Encoder) uint64 {
+	knownReceivedCount := fe.KnownReceivedCount()
+	if e.isBlockingLocked(streamID, knownReceivedCount) {
+		return fe.InsertCount()
+	}
+	var n uint64
+	for id := range e.streams {
+		if e.isBlockingLocked(id, knownReceivedCount) {
+			n++
+		}
+	}
+	if n < e.maxBlockedStreams {
+		return fe.InsertCount()
+	}
+	return knownReceivedCount
+}
 
+// isBlockingLocked returns true if stream streamID has a field section that
+// may be blocked on inserts the peer's decoder is not known to have received.
+func (e *Encoder) isBlockingLocked(streamID, knownReceivedCount uint64) bool {
+	s, ok := e.streams[streamID]
+	if !ok {
+		return false
+	}
+	for _, sec := range s.sections {
+		if sec.RequiredInsertCount > knownReceivedCount {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendEncoderInstructions appends the pending encoder stream instructions
+// to p, for sending to the peer's decoder.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-encoder-instructions
+func (e *Encoder) AppendEncoderInstructions(p []byte) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p = append(p, e.instructions...)
+	e.instructions = e.instructions[:0]
+	return p
+}
+
+// ParseDecoderInstructions parses the instructions received on the peer's
+// decoder stream. Instructions may be split across calls at any byte
+// boundary, an incomplete instruction is retained until the remainder
+// arrives.
+func (e *Encoder) ParseDecoderInstructions(in []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.partial) > 0 {
+		in = append(e.partial, in...)
+	}
+	rest, err := e.readDecoderInstructions(in)
+	if errors.Is(err, varint.ErrUnexpectedEnd) {
+		// Incomplete instruction, await more input.
+		err = nil
+	}
+	e.partial = append(e.partial[:0], rest...)
+	if e.maxTableCapacity > 0 {
+		// Replaced only if the Known Received Count changed.
+		if fe := e.dt.Encoder(); fe != e.fieldEncoder.Load() {
+			e.fieldEncoder.Store(fe)
+		}
+	}
+	if err != nil {
+		return ErrDecoderStream{err}
+	}
+	return nil
+}
+
+// readDecoderInstructions https://www.rfc-editor.org/rfc/rfc9204.html#name-decoder-instructions
+// Returns the remainder of p from the instruction that failed to be read.
+func (e *Encoder) readDecoderInstructions(p []byte) ([]byte, error) {
 	for len(p) > 0 {
 		switch p[0] >> 6 {
 		case 0b00:
 			// https://www.rfc-editor.org/rfc/rfc9204.html#name-insert-count-increment
-			increment, p, err = varint.Read(p, 0b0011_1111)
+			increment, q, err := varint.Read(p, 0b0011_1111)
 			if err != nil {
-				return err
+				return p, err
 			}
-			if err := e.increment(increment); err != nil {
-				return err
+			if err := e.incrementLocked(increment); err != nil {
+				return p, err
 			}
+			p = q
 
 		case 0b01:
 			// https://www.rfc-editor.org/rfc/rfc9204.html#name-stream-cancellation
-			streamID, p, err = varint.Read(p, 0b0011_1111)
+			streamID, q, err := varint.Read(p, 0b0011_1111)
 			if err != nil {
-				return err
+				return p, err
 			}
-			e.streamInstruction(streamID, (*stream).streamCancellation, true)
+			e.streamCancellationLocked(streamID)
+			p = q
 
 		case 0b10, 0b11:
 			// https://www.rfc-editor.org/rfc/rfc9204.html#name-section-acknowledgment
-			streamID, p, err = varint.Read(p, 0b0111_1111)
+			streamID, q, err := varint.Read(p, 0b0111_1111)
 			if err != nil {
-				return err
+				return p, err
 			}
-			e.streamInstruction(streamID, (*stream).sectionAcknowledgement, false)
+			if err := e.sectionAcknowledgementLocked(streamID); err != nil {
+				return p, err
+			}
+			p = q
 		}
 	}
-	return nil
+	return p, nil
 }
 
-func (e *Encoder) streamInstruction(streamID uint64, f func(s *stream), remove bool) {
+// addSectionLocked records a field section encoded on stream streamID that
+// references the dynamic table, to await acknowledgement. The section's
+// references must already be acquired.
+func (e *Encoder) addSectionLocked(streamID uint64, sec *field.Section) {
+	s, ok := e.streams[streamID]
+	if !ok {
+		s = &stream{}
+		e.streams[streamID] = s
+	}
+	s.sections = append(s.sections, sec)
 }
 
-func (e *Encoder) increment(increment uint64) error {
+func (e *Encoder) sectionAcknowledgementLocked(streamID uint64) error {
+	s, ok := e.streams[streamID]
+	if !ok {
+		return errUnexpectedAcknowledgement
+	}
+	sec, ok := s.sectionAcknowledgement()
+	if !ok {
+		return errUnexpectedAcknowledgement
+	}
+	if len(s.sections) == 0 {
+		delete(e.streams, streamID)
+	}
+	sec.Release()
+	e.dt.Acknowledge(sec.RequiredInsertCount)
 	return nil
 }
+
+func (e *Encoder) streamCancellationLocked(streamID uint64) {
+	s, ok := e.streams[streamID]
+	if !ok {
+		return
+	}
+	for _, sec := range s.streamCancellation() {
+		sec.Release()
+	}
+	delete(e.streams, streamID)
+}
+
+func (e *Encoder) incrementLocked(increment uint64) error {
+	return e.dt.Increment(increment)
+}
@@ -0,0 +1,524 @@
+package quack
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/renthraysk/quack/internal/inst"
+)
+
+func TestEncoderDecoderInstructions(t *testing.T) {
+
+	e := NewEncoder(MaxTableCapacity(220), MaxBlockedStreams(2))
+
+	encode := func(streamID uint64, name string) {
+		t.Helper()
+		header := map[string][]string{name: {"value"}}
+		if _, err := e.AppendRequest(nil, streamID, "GET", "https", "example.com", "/", header); err != nil {
+			t.Fatalf("unexpected encode error %v", err)
+		}
+	}
+	parse := func(s string) error {
+		t.Helper()
+		return e.ParseDecoderInstructions(dehex(t, s))
+	}
+	expectKnownReceivedCount := func(n uint64) {
+		t.Helper()
+		if krc := e.dt.KnownReceivedCount(); krc != n {
+			t.Errorf("expected known received count %d, got %d", n, krc)
+		}
+	}
+
+	// Each field section references a new insert.
+	encode(4, "X-A")
+	encode(8, "X-B")
+	encode(8, "X-C")
+
+	// Section Acknowledgment (Stream=4)
+	if err := parse("84"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectKnownReceivedCount(1)
+	// Insert Count Increment (1)
+	if err := parse("01"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectKnownReceivedCount(2)
+	// Section Acknowledgment (Stream=8), acknowledges the oldest section.
+	if err := parse("88"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expectKnownReceivedCount(2)
+	// Stream Cancellation (Stream=8)
+	if err := parse("48"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(e.streams) != 0 {
+		t.Errorf("expected no tracked streams, got %d", len(e.streams))
+	}
+	// Section Acknowledgment (Stream=4) with nothing to acknowledge.
+	var ds ErrDecoderStream
+	if err := parse("84"); !errors.As(err, &ds) {
+		t.Errorf("expected ErrDecoderStream, got %v", err)
+	}
+	// Insert Count Increment beyond the inserts made.
+	if err := parse("02"); !errors.As(err, &ds) {
+		t.Errorf("expected ErrDecoderStream, got %v", err)
+	}
+	// Insert Count Increment of zero.
+	if err := parse("00"); !errors.As(err, &ds) {
+		t.Errorf("expected ErrDecoderStream, got %v", err)
+	}
+}
+
+func TestEncoderFragmentedDecoderStream(t *testing.T) {
+
+	e := NewEncoder(MaxTableCapacity(220), MaxBlockedStreams(1))
+
+	header := map[string][]string{"X-A": {"value"}}
+	if _, err := e.AppendRequest(nil, 200, "GET", "https", "example.com", "/", header); err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	// Section Acknowledgment (Stream=200), split across reads.
+	p := inst.AppendSectionAcknowledgement(nil, 200)
+	if len(p) != 2 {
+		t.Fatalf("expected 2 byte instruction, got %d", len(p))
+	}
+	if err := e.ParseDecoderInstructions(p[:1]); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(e.streams) != 1 {
+		t.Fatal("expected section to remain unacknowledged")
+	}
+	if err := e.ParseDecoderInstructions(p[1:]); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(e.streams) != 0 {
+		t.Error("expected section to be acknowledged")
+	}
+}
+
+func TestEncoderDynamicTable(t *testing.T) {
+
+	e := NewEncoder(MaxTableCapacity(220), MaxBlockedStreams(1))
+	d := NewDecoder(MaxTableCapacity(220), MaxBlockedStreams(1))
+
+	decode := func(streamID uint64, in []byte) []headerField {
+		t.Helper()
+		var got []headerField
+		err := d.Decode(streamID, in, func(name, value string) {
+			got = append(got, headerField{name, value})
+		}, nil)
+		if err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+		return got
+	}
+
+	header := map[string][]string{"X-Custom": {"value"}}
+
+	p, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/", header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	if len(e.streams) != 1 {
+		t.Fatalf("expected section referencing dynamic table to be tracked")
+	}
+	// Blocked streams limit reached, so stream 4 can not reference the
+	// unacknowledged insert.
+	q, err := e.AppendRequest(nil, 4, "GET", "https", "example.com", "/", header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	if got := decode(4, q); got[len(got)-1] != (headerField{"X-Custom", "value"}) {
+		t.Errorf("expected X-Custom field, got %v", got)
+	}
+	if len(e.streams) != 1 {
+		t.Fatalf("expected only one stream to be tracked, got %d", len(e.streams))
+	}
+
+	if err := d.ParseEncoderInstructions(e.AppendEncoderInstructions(nil)); err != nil {
+		t.Fatalf("unexpected encoder stream error %v", err)
+	}
+	if got := decode(0, p); got[len(got)-1] != (headerField{"X-Custom", "value"}) {
+		t.Errorf("expected X-Custom field, got %v", got)
+	}
+	if err := e.ParseDecoderInstructions(d.AppendDecoderInstructions(nil)); err != nil {
+		t.Fatalf("unexpected decoder stream error %v", err)
+	}
+	if len(e.streams) != 0 {
+		t.Errorf("expected acknowledged section to be released")
+	}
+	if krc := e.dt.KnownReceivedCount(); krc != 1 {
+		t.Errorf("expected known received count 1, got %d", krc)
+	}
+
+	// Acknowledged, so referencing the entry does not count as blocking.
+	r, err := e.AppendRequest(nil, 8, "GET", "https", "example.com", "/", header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	if len(r) >= len(q) {
+		t.Errorf("expected indexed reference to shorten field section")
+	}
+	if got := decode(8, r); got[len(got)-1] != (headerField{"X-Custom", "value"}) {
+		t.Errorf("expected X-Custom field, got %v", got)
+	}
+}
+
+func TestEncoderNonBlocking(t *testing.T) {
+
+	e := NewEncoder(MaxTableCapacity(220))
+	d := NewDecoder(MaxTableCapacity(220))
+
+	decode := func(streamID uint64, in []byte) {
+		t.Helper()
+		// Never blocked, so done is never called.
+		if err := d.Decode(streamID, in, func(string, string) {}, nil); err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+	}
+
+	header := map[string][]string{"X-Custom": {"value"}}
+
+	p, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/", header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	// Inserted, but unacknowledged so not referenced.
+	decode(0, p)
+	if len(e.streams) != 0 {
+		t.Fatalf("expected no sections referencing the dynamic table")
+	}
+
+	if err := d.ParseEncoderInstructions(e.AppendEncoderInstructions(nil)); err != nil {
+		t.Fatalf("unexpected encoder stream error %v", err)
+	}
+	if err := e.ParseDecoderInstructions(d.AppendDecoderInstructions(nil)); err != nil {
+		t.Fatalf("unexpected decoder stream error %v", err)
+	}
+
+	q, err := e.AppendRequest(nil, 4, "GET", "https", "example.com", "/", header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	if len(q) >= len(p) {
+		t.Errorf("expected acknowledged entry to be referenced")
+	}
+	decode(4, q)
+	if err := e.ParseDecoderInstructions(d.AppendDecoderInstructions(nil)); err != nil {
+		t.Fatalf("unexpected decoder stream error %v", err)
+	}
+	if len(e.streams) != 0 {
+		t.Errorf("expected acknowledged section to be released")
+	}
+}
+
+func TestEncoderIndexedFieldSection(t *testing.T) {
+	for _, opts := range [][]Option{
+		{MaxTableCapacity(220)},
+		{MaxTableCapacity(220), MaxBlockedStreams(1)},
+	} {
+		e := NewEncoder(opts...)
+		d := NewDecoder(MaxTableCapacity(220), MaxBlockedStreams(1))
+
+		header := map[string][]string{"X-Custom": {"value"}}
+		exchange := func(streamID uint64) {
+			t.Helper()
+			p, err := e.AppendRequest(nil, streamID, "GET", "https", "example.com", "/", header)
+			if err != nil {
+				t.Fatalf("unexpected encode error %v", err)
+			}
+			if err := d.ParseEncoderInstructions(e.AppendEncoderInstructions(nil)); err != nil {
+				t.Fatalf("unexpected encoder stream error %v", err)
+			}
+			if err := d.Decode(streamID, p, func(string, string) {}, nil); err != nil {
+				t.Fatalf("unexpected decode error %v", err)
+			}
+			if err := e.ParseDecoderInstructions(d.AppendDecoderInstructions(nil)); err != nil {
+				t.Fatalf("unexpected decoder stream error %v", err)
+			}
+		}
+		exchange(0)
+
+		// Already inserted and acknowledged, so the dynamic table, and the
+		// field Encoder, are left unchanged.
+		fe := e.fieldEncoder.Load()
+		exchange(4)
+		if e.fieldEncoder.Load() != fe {
+			t.Errorf("expected the field Encoder unchanged")
+		}
+		if p := e.AppendEncoderInstructions(nil); len(p) != 0 {
+			t.Errorf("expected no encoder instructions, got %x", p)
+		}
+	}
+}
+
+func TestEncoderNonBlockingConcurrent(t *testing.T) {
+	const goroutines = 8
+	const requests = 50
+
+	e := NewEncoder(MaxTableCapacity(512))
+	d := NewDecoder(MaxTableCapacity(512))
+
+	type encoded struct {
+		streamID uint64
+		p        []byte
+	}
+	ch := make(chan encoded)
+
+	for g := range goroutines {
+		go func() {
+			for i := range requests {
+				streamID := uint64(4 * (g*requests + i))
+				header := map[string][]string{
+					"X-Goroutine": {string(rune('a' + g))},
+					"X-Request":   {string(rune('a' + i%8))},
+				}
+				p, err := e.AppendRequest(nil, streamID, "GET", "https", "example.com", "/", header)
+				if err != nil {
+					t.Errorf("unexpected encode error %v", err)
+				}
+				ch <- encoded{streamID, p}
+			}
+		}()
+	}
+	for range goroutines * requests {
+		x := <-ch
+		if err := d.ParseEncoderInstructions(e.AppendEncoderInstructions(nil)); err != nil {
+			t.Fatalf("unexpected encoder stream error %v", err)
+		}
+		if err := d.Decode(x.streamID, x.p, func(string, string) {}, nil); err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+		if err := e.ParseDecoderInstructions(d.AppendDecoderInstructions(nil)); err != nil {
+			t.Fatalf("unexpected decoder stream error %v", err)
+		}
+	}
+}
+
+func TestEncoderFieldOrder(t *testing.T) {
+	d := NewDecoder()
+	decode := func(p []byte) []string {
+		t.Helper()
+		var names []string
+		err := d.Decode(0, p, func(name, value string) {
+			if name[0] != ':' {
+				names = append(names, name)
+			}
+		}, nil)
+		if err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+		return names
+	}
+
+	fields := []Field{
+		{Name: "X-C", Value: "3"},
+		{Name: "X-A", Value: "1"},
+		{Name: "Accept", Value: "*/*"},
+		{Name: "X-B", Value: "2"},
+		{Name: "X-A", Value: "4"},
+	}
+	p, err := NewEncoder().AppendRequestFields(nil, 0, "GET", "https", "example.com", "/", fields)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	names := decode(p)
+	if len(names) != len(fields) {
+		t.Fatalf("expected %d fields, got %v", len(fields), names)
+	}
+	for i, f := range fields {
+		if names[i] != f.Name {
+			t.Errorf("expected %s at %d, got %s", f.Name, i, names[i])
+		}
+	}
+
+	header := map[string][]string{
+		"X-C": {"3"}, "X-A": {"1", "4"}, "Accept": {"*/*"}, "X-B": {"2"},
+		"X-E": {"5"}, "X-D": {"6"}, "X-F": {"7"}, "X-G": {"8"},
+	}
+	e := NewEncoder(SortedFields())
+	expected, err := e.AppendResponse(nil, 0, 200, header)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		p, err := e.AppendResponse(nil, 0, 200, header)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if string(p) != string(expected) {
+			t.Fatalf("expected identical encodings")
+		}
+	}
+	names = decode(expected)
+	if !slices.IsSorted(names[1:]) { // Date is automatically added first.
+		t.Errorf("expected sorted names, got %v", names)
+	}
+}
+
+func TestEncoderExtendedConnect(t *testing.T) {
+	e := NewEncoder(MaxTableCapacity(4096), MaxBlockedStreams(16))
+	d := NewDecoder(MaxTableCapacity(4096), MaxBlockedStreams(16))
+
+	header := map[string][]string{"Capsule-Protocol": {"?1"}}
+	p, err := e.AppendExtendedConnect(nil, 0, "connect-udp", "https", "proxy.example.com", "/.well-known/masque/udp/192.0.2.6/443/", header)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := d.ParseEncoderInstructions(e.AppendEncoderInstructions(nil)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var fields []headerField
+	err = d.Decode(0, p, func(name, value string) {
+		fields = append(fields, headerField{name, value})
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	expected := []headerField{
+		{":method", "CONNECT"},
+		{":protocol", "connect-udp"},
+		{":scheme", "https"},
+		{":authority", "proxy.example.com"},
+		{":path", "/.well-known/masque/udp/192.0.2.6/443/"},
+		{"Capsule-Protocol", "?1"},
+	}
+	if !slices.Equal(fields, expected) {
+		t.Errorf("expected %v, got %v", expected, fields)
+	}
+
+	for _, tt := range []struct{ protocol, scheme, authority, path string }{
+		{"", "https", "example.com", "/chat"},
+		{"web socket", "https", "example.com", "/chat"},
+		{"websocket", "", "example.com", "/chat"},
+		{"websocket", "https", "", "/chat"},
+		{"websocket", "https", "example.com", ""},
+	} {
+		if _, err := e.AppendExtendedConnect(nil, 4, tt.protocol, tt.scheme, tt.authority, tt.path, nil); err == nil {
+			t.Errorf("expected error for %+v", tt)
+		}
+	}
+}
+
+func TestNeverIndex(t *testing.T) {
+	opts := []Option{MaxTableCapacity(4096), MaxBlockedStreams(1)}
+
+	// relay decodes the field section of e, and re-encodes it with the
+	// never-index bits preserved, acknowledging it so later sections may
+	// reference its inserts.
+	relay := func(e *Encoder, d *Decoder, fields []Field) []Field {
+		t.Helper()
+		p, err := e.AppendRequestFields(nil, 0, "GET", "https", "example.com", "/", fields)
+		if err != nil {
+			t.Fatalf("unexpected encode error %v", err)
+		}
+		if err := d.ParseEncoderInstructions(e.AppendEncoderInstructions(nil)); err != nil {
+			t.Fatalf("unexpected encoder stream error %v", err)
+		}
+		var got []Field
+		err = d.DecodeFields(0, p, func(f Field) {
+			if f.Name[0] != ':' {
+				got = append(got, f)
+			}
+		}, nil)
+		if err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+		if err := e.ParseDecoderInstructions(d.AppendDecoderInstructions(nil)); err != nil {
+			t.Fatalf("unexpected decoder stream error %v", err)
+		}
+		return got
+	}
+
+	fields := []Field{
+		{Name: "X-Token", Value: "secret", NeverIndex: true},
+		{Name: "X-Public", Value: "value"},
+		{Name: "Accept", Value: "*/*", NeverIndex: true},
+	}
+	client, server := NewEncoder(opts...), NewDecoder(opts...)
+	proxy, upstream := NewEncoder(opts...), NewDecoder(opts...)
+
+	// The second pass references the acknowledged inserts of the first.
+	for range 2 {
+		got := relay(client, server, fields)
+		if !slices.Equal(got, fields) {
+			t.Fatalf("expected %v, got %v", fields, got)
+		}
+		got = relay(proxy, upstream, got)
+		if !slices.Equal(got, fields) {
+			t.Fatalf("expected %v relayed, got %v", fields, got)
+		}
+	}
+}
+
+func TestSensitiveFields(t *testing.T) {
+	sensitivity := func(name, value string) Sensitivity {
+		switch {
+		case name == "X-Api-Key":
+			return NeverIndex | NeverHuffman
+		case name == "Cookie" && strings.HasPrefix(value, "session="):
+			return NeverIndex
+		}
+		return DefaultSensitivity(name, value)
+	}
+	header := map[string][]string{
+		"X-Api-Key":     {"key-123"},
+		"Cookie":        {"theme=dark; session=abc"},
+		"Authorization": {"Bearer token"},
+		"Accept":        {"*/*"},
+	}
+	expected := map[string]bool{
+		"X-Api-Key":     true,
+		"Cookie":        true,
+		"Authorization": true,
+		"Accept":        false,
+	}
+
+	for _, opts := range [][]Option{
+		{SensitiveFields(sensitivity)},
+		{SensitiveFields(sensitivity), MaxTableCapacity(4096), MaxBlockedStreams(1)},
+	} {
+		e, d := NewEncoder(opts...), NewDecoder(opts...)
+		p, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/", header)
+		if err != nil {
+			t.Fatalf("unexpected encode error %v", err)
+		}
+		if !bytes.Contains(p, []byte("key-123")) {
+			t.Errorf("expected X-Api-Key value not Huffman encoded")
+		}
+		if err := d.ParseEncoderInstructions(e.AppendEncoderInstructions(nil)); err != nil {
+			t.Fatalf("unexpected encoder stream error %v", err)
+		}
+		err = d.DecodeFields(0, p, func(f Field) {
+			if neverIndex, ok := expected[f.Name]; ok && f.NeverIndex != neverIndex {
+				t.Errorf("expected %s never indexed %v, got %v", f.Name, neverIndex, f.NeverIndex)
+			}
+		}, nil)
+		if err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+	}
+
+	// The default policy applies otherwise.
+	d := NewDecoder()
+	p, err := NewEncoder().AppendRequest(nil, 0, "GET", "https", "example.com", "/", header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	err = d.DecodeFields(0, p, func(f Field) {
+		if f.Name == "X-Api-Key" && f.NeverIndex {
+			t.Errorf("expected X-Api-Key indexable by default")
+		}
+		if f.Name == "Authorization" && !f.NeverIndex {
+			t.Errorf("expected Authorization never indexed by default")
+		}
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package quack
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -10,6 +11,16 @@ const (
 	QpackDecoderStreamError  = 0x0202
 )
 
+// ErrBlocked is returned by Decoder.Decode when a field section is held
+// awaiting dynamic table inserts.
+var ErrBlocked = errors.New("qpack: field section blocked")
+
+// ErrFieldSectionTooLarge is returned when a field section exceeds the
+// maximum field section size. When decoding the limit is the local
+// MaxFieldSectionSize, when encoding the peer's.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-header-size-constraints
+var ErrFieldSectionTooLarge = errors.New("qpack: field section too large")
+
 // https://www.rfc-editor.org/rfc/rfc9204.html#name-error-handling
 
 type Error interface {
@@ -58,3 +69,130 @@ func (e ErrDecoderStream) Unwrap() error {
 func (e ErrDecoderStream) Error() string {
 	return fmt.Sprintf("qpack: decoder stream error: %s", e.err.Error())
 }
+
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-3-error-codes
+
+const (
+	H3StreamCreationError  = 0x0103
+	H3ClosedCriticalStream = 0x0104
+)
+
+// ErrStreamCreation is returned when a unidirectional stream does not begin
+// with the expected stream type.
+type ErrStreamCreation struct {
+	err error
+}
+
+func (e ErrStreamCreation) ErrorCode() uint16 { return H3StreamCreationError }
+
+func (e ErrStreamCreation) Unwrap() error {
+	return e.err
+}
+
+func (e ErrStreamCreation) Error() string {
+	return fmt.Sprintf("http3: stream creation error: %s", e.err.Error())
+}
+
+// ErrClosedCriticalStream is returned when the encoder or decoder stream is
+// closed, or otherwise fails.
+type ErrClosedCriticalStream struct {
+	err error
+}
+
+func (e ErrClosedCriticalStream) ErrorCode() uint16 { return H3ClosedCriticalStream }
+
+func (e ErrClosedCriticalStream) Unwrap() error {
+	return e.err
+}
+
+func (e ErrClosedCriticalStream) Error() string {
+	return fmt.Sprintf("http3: closed critical stream: %s", e.err.Error())
+}
+
+const (
+	H3FrameUnexpected = 0x0105
+	H3FrameError      = 0x0106
+	H3SettingsError   = 0x0109
+	H3MissingSettings = 0x010A
+	H3MessageError    = 0x010E
+)
+
+// ErrFrameUnexpected is returned when a frame is received that is not
+// permitted in the current state, or on the current stream.
+type ErrFrameUnexpected struct {
+	err error
+}
+
+func (e ErrFrameUnexpected) ErrorCode() uint16 { return H3FrameUnexpected }
+
+func (e ErrFrameUnexpected) Unwrap() error {
+	return e.err
+}
+
+func (e ErrFrameUnexpected) Error() string {
+	return fmt.Sprintf("http3: frame unexpected: %s", e.err.Error())
+}
+
+// ErrFrame is returned when a frame is malformed.
+type ErrFrame struct {
+	err error
+}
+
+func (e ErrFrame) ErrorCode() uint16 { return H3FrameError }
+
+func (e ErrFrame) Unwrap() error {
+	return e.err
+}
+
+func (e ErrFrame) Error() string {
+	return fmt.Sprintf("http3: frame error: %s", e.err.Error())
+}
+
+// ErrSettings is returned when a SETTINGS frame is malformed.
+type ErrSettings struct {
+	err error
+}
+
+func (e ErrSettings) ErrorCode() uint16 { return H3SettingsError }
+
+func (e ErrSettings) Unwrap() error {
+	return e.err
+}
+
+func (e ErrSettings) Error() string {
+	return fmt.Sprintf("http3: settings error: %s", e.err.Error())
+}
+
+// ErrMissingSettings is returned when the first frame of a control stream is
+// not a SETTINGS frame.
+type ErrMissingSettings struct {
+	err error
+}
+
+func (e ErrMissingSettings) ErrorCode() uint16 { return H3MissingSettings }
+
+func (e ErrMissingSettings) Unwrap() error {
+	return e.err
+}
+
+func (e ErrMissingSettings) Error() string {
+	return fmt.Sprintf("http3: missing settings: %s", e.err.Error())
+}
+
+// ErrMessage is returned when a field section is malformed at the HTTP
+// level, such as missing or misplaced pseudo-header fields. Unlike the QPACK
+// errors, it is a stream error.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-malformed-requests-and-resp
+type ErrMessage struct {
+	err error
+}
+
+func (e ErrMessage) ErrorCode() uint16 { return H3MessageError }
+
+func (e ErrMessage) Unwrap() error {
+	return e.err
+}
+
+func (e ErrMessage) Error() string {
+	return fmt.Sprintf("http3: message error: %s", e.err.Error())
+}
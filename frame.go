@@ -0,0 +1,265 @@
+package quack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/renthraysk/quack/quicvarint"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-frame-definitions
+
+const (
+	FrameData     = 0x00
+	FrameHeaders  = 0x01
+	FrameSettings = 0x04
+)
+
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-settings-parameters
+
+const (
+	SettingQpackMaxTableCapacity = 0x01
+	SettingMaxFieldSectionSize   = 0x06
+	SettingQpackBlockedStreams   = 0x07
+	SettingEnableConnectProtocol = 0x08
+)
+
+// maxFrameLength is the largest SETTINGS frame payload read, and HEADERS
+// frame payload absent a MaxFieldSectionSize.
+const maxFrameLength = 1 << 20
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// AppendHeadersFrame appends a HEADERS frame to p, with the field section
+// appended by appendFieldSection as its payload. For example
+//
+//	p, err = AppendHeadersFrame(p, func(p []byte) ([]byte, error) {
+//		return e.AppendResponse(p, streamID, 200, header)
+//	})
+//
+// The frame length is reserved ahead of the payload, so field sections of up
+// to 16383 bytes are not moved.
+func AppendHeadersFrame(p []byte, appendFieldSection func(p []byte) ([]byte, error)) ([]byte, error) {
+	i := len(p)
+	p = append(p, FrameHeaders, 0, 0)
+	p, err := appendFieldSection(p)
+	if err != nil {
+		return p[:i], err
+	}
+	return setFrameLength(p, i+1), nil
+}
+
+// setFrameLength sets the frame length at p[i:], where two bytes were
+// reserved for it, to the length of the remainder of p. Lengths below 64
+// use a two byte encoding, which need not be minimal.
+// https://www.rfc-editor.org/rfc/rfc9000.html#section-16
+func setFrameLength(p []byte, i int) []byte {
+	n := uint64(len(p) - i - 2)
+	if n <= 0x3FFF {
+		binary.BigEndian.PutUint16(p[i:], 0x4000|uint16(n))
+		return p
+	}
+	var buf [8]byte
+
+	length := quicvarint.Append(buf[:0], n)
+	copy(p[i:i+2], length)
+	return slices.Insert(p, i+2, length[2:]...)
+}
+
+// ReadHeadersFrame reads frames from the request stream r until a HEADERS
+// frame, whose field section is decoded as Decode. Frames of unknown type
+// are skipped, any other frame is unexpected. Returns io.EOF if r ends before
+// a frame begins. Server push is unsupported, so PUSH_PROMISE frames are also
+// treated as unexpected; clients that send MAX_PUSH_ID must read the frames
+// of request streams themselves.
+func (d *Decoder) ReadHeadersFrame(r io.Reader, streamID uint64, accept func(name, value string), done func(error)) error {
+	for {
+		typ, length, err := readFrameHeader(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case FrameHeaders:
+			payload, err := readFramePayload(r, length, d.maxHeadersFrameLength())
+			if err != nil {
+				return err
+			}
+			return d.Decode(streamID, payload, accept, done)
+		case 0x00, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0D:
+			// Known frame types, including those reserved from HTTP/2.
+			// PUSH_PROMISE (0x05) is only expected by clients permitting
+			// push, which is unsupported.
+			return ErrFrameUnexpected{fmt.Errorf("frame type %#x", typ)}
+		}
+		// https://www.rfc-editor.org/rfc/rfc9114.html#name-frame-definitions
+		// Frame types that are unknown MUST be ignored.
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return ErrFrame{err}
+		}
+	}
+}
+
+// maxHeadersFrameLength returns the largest HEADERS frame payload read, the
+// longest encoding of a field section within MaxFieldSectionSize. Huffman
+// encoding expands literals by up to 30 bits per octet, the 32 octets added
+// per field line covering their length prefixes.
+func (d *Decoder) maxHeadersFrameLength() uint64 {
+	switch size := d.maxFieldSectionSize; {
+	case size == math.MaxUint64:
+		return maxFrameLength
+	case size > (math.MaxInt-32)/4:
+		return math.MaxInt
+	default:
+		return 4*size + 32
+	}
+}
+
+// AppendSettingsFrame appends a SETTINGS frame of the settings s to p.
+// Settings of 0 or false, their default, are omitted. A MaxFieldSectionSize of 0 is
+// unlimited.
+func AppendSettingsFrame(p []byte, s Settings) []byte {
+	i := len(p)
+	p = append(p, FrameSettings, 0, 0)
+	if s.MaxTableCapacity > 0 {
+		p = quicvarint.Append(p, SettingQpackMaxTableCapacity)
+		p = quicvarint.Append(p, s.MaxTableCapacity)
+	}
+	if s.MaxFieldSectionSize > 0 {
+		p = quicvarint.Append(p, SettingMaxFieldSectionSize)
+		p = quicvarint.Append(p, s.MaxFieldSectionSize)
+	}
+	if s.BlockedStreams > 0 {
+		p = quicvarint.Append(p, SettingQpackBlockedStreams)
+		p = quicvarint.Append(p, s.BlockedStreams)
+	}
+	if s.EnableConnectProtocol {
+		p = quicvarint.Append(p, SettingEnableConnectProtocol)
+		p = quicvarint.Append(p, 1)
+	}
+	return setFrameLength(p, i+1)
+}
+
+// ReadSettingsFrame reads the SETTINGS frame that begins a control stream,
+// following the stream type, from r.
+func ReadSettingsFrame(r io.Reader) (Settings, error) {
+	typ, length, err := readFrameHeader(r)
+	if err != nil {
+		return Settings{}, err
+	}
+	if typ != FrameSettings {
+		// https://www.rfc-editor.org/rfc/rfc9114.html#name-settings
+		// If the first frame of the control stream is any other frame type,
+		// this MUST be treated as a connection error of type
+		// H3_MISSING_SETTINGS.
+		return Settings{}, ErrMissingSettings{fmt.Errorf("frame type %#x, expected SETTINGS", typ)}
+	}
+	payload, err := readFramePayload(r, length, maxFrameLength)
+	if err != nil {
+		return Settings{}, err
+	}
+	return ParseSettings(payload)
+}
+
+// ParseSettings parses the payload of a SETTINGS frame, returning the
+// settings of Settings. Unknown settings are ignored.
+func ParseSettings(payload []byte) (Settings, error) {
+	var s Settings
+	var seen uint64
+
+	for len(payload) > 0 {
+		id, q, err := quicvarint.Read(payload)
+		if err != nil {
+			return s, ErrFrame{err}
+		}
+		value, q, err := quicvarint.Read(q)
+		if err != nil {
+			return s, ErrFrame{err}
+		}
+		payload = q
+
+		if id < 64 {
+			// A setting identifier that appears more than once MUST be
+			// treated as a connection error of type H3_SETTINGS_ERROR.
+			if seen&(1<<id) != 0 {
+				return s, ErrSettings{fmt.Errorf("duplicate setting %#x", id)}
+			}
+			seen |= 1 << id
+		}
+		switch id {
+		case SettingQpackMaxTableCapacity:
+			s.MaxTableCapacity = value
+		case SettingMaxFieldSectionSize:
+			// A limit of 0 can not be represented, so is treated as the
+			// smallest limit.
+			s.MaxFieldSectionSize = max(value, 1)
+		case SettingQpackBlockedStreams:
+			s.BlockedStreams = value
+		case SettingEnableConnectProtocol:
+			if value > 1 {
+				return s, ErrSettings{fmt.Errorf("invalid SETTINGS_ENABLE_CONNECT_PROTOCOL value %d", value)}
+			}
+			s.EnableConnectProtocol = value == 1
+		case 0x02, 0x03, 0x04, 0x05:
+			// Setting identifiers that were defined in HTTP/2 where there
+			// is no corresponding HTTP/3 setting.
+			return s, ErrSettings{fmt.Errorf("reserved setting %#x", id)}
+		}
+	}
+	return s, nil
+}
+
+// readFrameHeader reads the type and length of a frame from r. Returns
+// io.EOF if r ends before the frame.
+func readFrameHeader(r io.Reader) (typ, length uint64, err error) {
+	if typ, err = readVarint(r); err != nil {
+		if err == io.EOF {
+			return 0, 0, io.EOF
+		}
+		return 0, 0, ErrFrame{err}
+	}
+	if length, err = readVarint(r); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, ErrFrame{err}
+	}
+	return typ, length, nil
+}
+
+// readFramePayload reads a frame payload of length bytes, at most maxLength,
+// from r.
+func readFramePayload(r io.Reader, length, maxLength uint64) ([]byte, error) {
+	if length > maxLength {
+		return nil, ErrFrame{errFrameTooLarge}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, ErrFrame{err}
+	}
+	return payload, nil
+}
+
+// readVarint reads a QUIC variable-length integer from r. Returns io.EOF if
+// r ends before the integer.
+func readVarint(r io.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, err
+	}
+	n := quicvarint.PrefixLen(b[0])
+	if _, err := io.ReadFull(r, b[1:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	x, _, err := quicvarint.Read(b[:n])
+	return x, err
+}
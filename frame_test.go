@@ -0,0 +1,161 @@
+package quack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/renthraysk/quack/quicvarint"
+)
+
+func TestHeadersFrame(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder()
+
+	for _, size := range []int{0, 100, 20000} {
+		header := map[string][]string{"X-Custom": {strings.Repeat("a", size)}}
+
+		var section []byte
+		p, err := AppendHeadersFrame([]byte("prefix"), func(p []byte) ([]byte, error) {
+			p, err := e.AppendRequest(p, 0, "GET", "https", "example.com", "/", header)
+			section = p[len("prefix")+3:]
+			return p, err
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !bytes.HasPrefix(p, []byte("prefix")) {
+			t.Fatalf("expected prefix to be preserved")
+		}
+		p = p[len("prefix"):]
+
+		// Precede with a reserved frame type, which must be ignored.
+		// https://www.rfc-editor.org/rfc/rfc9114.html#name-reserved-frame-types
+		r := quicvarint.Append(nil, 0x21)
+		r = quicvarint.Append(r, 3)
+		r = append(r, "abc"...)
+		r = append(r, p...)
+
+		var value string
+		accept := func(name, v string) {
+			if name == "X-Custom" {
+				value = v
+			}
+		}
+		if err := d.ReadHeadersFrame(bytes.NewReader(r), 0, accept, nil); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if value != header["X-Custom"][0] {
+			t.Errorf("expected X-Custom of length %d, got %d", size, len(value))
+		}
+		if size <= 0x3FFF && !bytes.Equal(p[3:], section) {
+			t.Errorf("expected field section in place")
+		}
+	}
+
+	// Field section errors leave p untouched.
+	p, err := AppendHeadersFrame([]byte("prefix"), func(p []byte) ([]byte, error) {
+		return e.AppendRequest(p, 0, "GET", "https", "", "/", nil)
+	})
+	if err == nil || string(p) != "prefix" {
+		t.Errorf("expected error, and prefix only, got %q, %v", p, err)
+	}
+
+	var fu ErrFrameUnexpected
+	if err := d.ReadHeadersFrame(bytes.NewReader([]byte{FrameData, 0}), 0, nil, nil); !errors.As(err, &fu) {
+		t.Errorf("expected frame unexpected error, got %v", err)
+	}
+	var fe ErrFrame
+	if err := d.ReadHeadersFrame(bytes.NewReader([]byte{FrameHeaders, 4, 0}), 0, nil, nil); !errors.As(err, &fe) {
+		t.Errorf("expected frame error, got %v", err)
+	}
+	if err := d.ReadHeadersFrame(bytes.NewReader(nil), 0, nil, nil); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestHeadersFrameLength(t *testing.T) {
+	e := NewEncoder()
+	// Each value within the 1MiB limit of a Huffman decoded literal, yet
+	// together encoding to more than 1MiB.
+	value := strings.Repeat("a", 700<<10)
+	header := map[string][]string{"X-Custom": {value, value, value}}
+	p, err := AppendHeadersFrame(nil, func(p []byte) ([]byte, error) {
+		return e.AppendRequest(p, 0, "GET", "https", "example.com", "/", header)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if len(p) <= maxFrameLength {
+		t.Fatalf("expected frame longer than %d, got %d", maxFrameLength, len(p))
+	}
+
+	// Field sections within a MaxFieldSectionSize above 1MiB are read.
+	d := NewDecoder(MaxFieldSectionSize(4 << 20))
+	if err := d.ReadHeadersFrame(bytes.NewReader(p), 0, func(name, value string) {}, nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// Payloads too long to be within a smaller MaxFieldSectionSize are
+	// refused before being read.
+	d = NewDecoder(MaxFieldSectionSize(64))
+	frame := quicvarint.Append([]byte{FrameHeaders}, 4*64+33)
+	var fe ErrFrame
+	if err := d.ReadHeadersFrame(bytes.NewReader(frame), 0, nil, nil); !errors.As(err, &fe) || !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("expected frame too large error, got %v", err)
+	}
+}
+
+func TestSettingsFrame(t *testing.T) {
+	for _, s := range []Settings{
+		{},
+		{MaxTableCapacity: 4096},
+		{MaxTableCapacity: 1 << 30, BlockedStreams: 100},
+		{MaxTableCapacity: 4096, BlockedStreams: 16, MaxFieldSectionSize: 16384},
+		{EnableConnectProtocol: true},
+	} {
+		p := AppendSettingsFrame(nil, s)
+		got, err := ReadSettingsFrame(bytes.NewReader(p))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if got != s {
+			t.Errorf("expected %+v, got %+v", s, got)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		err     any
+	}{
+		{"duplicate", "0101 0102", &ErrSettings{}},
+		{"reserved", "0200", &ErrSettings{}},
+		{"truncated", "01", &ErrFrame{}},
+		{"enable connect protocol", "0802", &ErrSettings{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSettings(dehex(t, strings.ReplaceAll(tt.payload, " ", "")))
+			if !errors.As(err, tt.err) {
+				t.Errorf("expected %T, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// Unknown settings are ignored.
+	s, err := ParseSettings(dehex(t, "21000707"))
+	if err != nil || s.BlockedStreams != 7 {
+		t.Errorf("unexpected settings %+v, %v", s, err)
+	}
+
+	var ms ErrMissingSettings
+	if _, err := ReadSettingsFrame(bytes.NewReader([]byte{FrameHeaders, 0})); !errors.As(err, &ms) {
+		t.Errorf("expected missing settings error, got %v", err)
+	} else if ms.ErrorCode() != H3MissingSettings {
+		t.Errorf("expected error code %#x, got %#x", H3MissingSettings, ms.ErrorCode())
+	}
+}
@@ -0,0 +1,294 @@
+package quack
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/renthraysk/quack/internal/field"
+)
+
+// httpHeader is the Header of an http.Header, omitting the Host,
+// connection-specific fields and trailers, with names prefixed by
+// http.TrailerPrefix, that net/http may include, and adding the
+// Content-Length if known.
+type httpHeader struct {
+	field.Header
+	// contentLength to add, -1 if unknown or already present.
+	contentLength int64
+}
+
+// newHTTPHeader returns the Header of h, adding a Content-Length field of
+// contentLength if positive and absent.
+func (e *Encoder) newHTTPHeader(h http.Header, contentLength int64) httpHeader {
+	hh := httpHeader{Header: e.header(h), contentLength: -1}
+	if _, ok := h["Content-Length"]; !ok && contentLength > 0 {
+		hh.contentLength = contentLength
+	}
+	return hh
+}
+
+func (h httpHeader) Fields(f func(Field)) {
+	if h.contentLength >= 0 {
+		f(Field{Name: "Content-Length", Value: strconv.FormatInt(h.contentLength, 10)})
+	}
+	h.Header.Fields(func(fl Field) {
+		if !omitHTTPField(fl.Name, fl.Value) {
+			f(fl)
+		}
+	})
+}
+
+func (h httpHeader) Has(name string) bool {
+	switch {
+	case name == "Content-Length" && h.contentLength >= 0:
+		return true
+	case omitHTTPField(name, ""):
+		return false
+	}
+	return h.Header.Has(name)
+}
+
+// omitHTTPField reports whether a field of an http.Header is omitted from
+// field sections.
+func omitHTTPField(name, value string) bool {
+	return name == "Host" || isConnectionSpecific(name, value) || strings.HasPrefix(name, http.TrailerPrefix)
+}
+
+// AppendHTTPRequest appends the field section of the header of r, for stream
+// streamID, to p. The :authority is r.Host, or if empty r.URL.Host, and
+// :path the request URI of r.URL, including any opaque form. An OPTIONS
+// request without a path has a :path of "*". Connection-specific fields are
+// omitted.
+func (e *Encoder) AppendHTTPRequest(p []byte, streamID uint64, r *http.Request) ([]byte, error) {
+	if r.URL == nil {
+		return p, errors.New("nil Request.URL")
+	}
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	authority := r.Host
+	if authority == "" {
+		authority = r.URL.Host
+	}
+	header := e.newHTTPHeader(r.Header, r.ContentLength)
+	if method == http.MethodConnect {
+		return e.appendConnect(p, streamID, authority, header)
+	}
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	var path string
+	if r.URL.Opaque != "" || r.URL.Path != "" || r.URL.RawQuery != "" {
+		path = r.URL.RequestURI()
+	}
+	return e.appendRequest(p, streamID, method, scheme, authority, path, header)
+}
+
+// AppendHTTPResponse appends the field section of a response of statusCode
+// and header, for stream streamID, to p. Connection-specific fields are
+// omitted.
+func (e *Encoder) AppendHTTPResponse(p []byte, streamID uint64, statusCode int, header http.Header) ([]byte, error) {
+	return e.appendResponse(p, streamID, statusCode, e.newHTTPHeader(header, -1))
+}
+
+// AppendHTTPTrailers appends the trailer section, for stream streamID, to p
+// of the trailers of header, following the conventions of
+// http.ResponseWriter. Trailers are the fields named by the Trailer field,
+// and those whose names are prefixed with http.TrailerPrefix, the prefix
+// removed.
+func (e *Encoder) AppendHTTPTrailers(p []byte, streamID uint64, header http.Header) ([]byte, error) {
+	trailers := make(http.Header)
+	for _, names := range header["Trailer"] {
+		for _, name := range strings.Split(names, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := header[name]; ok {
+				trailers[name] = values
+			}
+		}
+	}
+	for name, values := range header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			name = http.CanonicalHeaderKey(name[len(http.TrailerPrefix):])
+			trailers[name] = append(trailers[name], values...)
+		}
+	}
+	return e.appendTrailers(p, streamID, e.newHTTPHeader(trailers, -1))
+}
+
+// DecodeHTTPTrailers decodes a trailer section as DecodeTrailers, returning
+// the trailers as an http.Header. If blocked returns ErrBlocked, with the
+// outcome later passed to done, unless nil as Decode.
+func (d *Decoder) DecodeHTTPTrailers(streamID uint64, in []byte, done func(http.Header, error)) (http.Header, error) {
+	header := make(http.Header)
+	accept := func(name, value string) {
+		header[name] = append(header[name], value)
+	}
+	var unblocked func(error)
+	if done != nil {
+		unblocked = func(err error) {
+			if err != nil {
+				done(nil, err)
+				return
+			}
+			done(header, nil)
+		}
+	}
+	err := d.DecodeTrailers(streamID, in, accept, unblocked)
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// announcedTrailers returns the trailers announced by the Trailer field of
+// header, as keys without values, or nil if none.
+func announcedTrailers(header http.Header) http.Header {
+	var trailer http.Header
+	for _, names := range header["Trailer"] {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if trailer == nil {
+				trailer = make(http.Header)
+			}
+			trailer[http.CanonicalHeaderKey(name)] = nil
+		}
+	}
+	return trailer
+}
+
+// DecodeHTTPRequest decodes a request header section as DecodeRequest,
+// returning an http.Request. The Body is http.NoBody, to be replaced by the
+// caller. The :protocol of an extended CONNECT request is present in Header,
+// as net/http's HTTP/2 server does. If blocked returns ErrBlocked, with the
+// outcome later passed to done, unless nil as Decode.
+func (d *Decoder) DecodeHTTPRequest(streamID uint64, in []byte, done func(*http.Request, error)) (*http.Request, error) {
+	var req Request
+	header := make(http.Header)
+	accept := func(name, value string) {
+		header[name] = append(header[name], value)
+	}
+	var unblocked func(error)
+	if done != nil {
+		unblocked = func(err error) {
+			if err != nil {
+				done(nil, err)
+				return
+			}
+			done(newHTTPRequest(&req, header))
+		}
+	}
+	err := d.DecodeRequest(streamID, in, &req, accept, unblocked)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPRequest(&req, header)
+}
+
+func newHTTPRequest(req *Request, header http.Header) (*http.Request, error) {
+	contentLength, err := parseContentLength(header)
+	if err != nil {
+		return nil, err
+	}
+	r := &http.Request{
+		Method:        req.Method,
+		Proto:         "HTTP/3.0",
+		ProtoMajor:    3,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: contentLength,
+		Host:          req.Authority,
+		RequestURI:    req.Path,
+		Trailer:       announcedTrailers(header),
+	}
+	if r.Host == "" {
+		r.Host = header.Get("Host")
+	}
+	delete(header, "Host")
+
+	if req.Method == http.MethodConnect && req.Protocol == "" {
+		r.URL = &url.URL{Host: req.Authority}
+		r.RequestURI = req.Authority
+		return r, nil
+	}
+	if req.Protocol != "" {
+		header[":protocol"] = []string{req.Protocol}
+	}
+	if r.URL, err = url.ParseRequestURI(req.Path); err != nil {
+		return nil, ErrMessage{err}
+	}
+	r.URL.Scheme = req.Scheme
+	r.URL.Host = r.Host
+	return r, nil
+}
+
+// DecodeHTTPResponse decodes a response header section as DecodeResponse,
+// returning an http.Response, with Trailer holding the announced trailers.
+// The Body is http.NoBody, to be replaced by the caller. If blocked returns
+// ErrBlocked, with the outcome later passed to done, unless nil as Decode.
+func (d *Decoder) DecodeHTTPResponse(streamID uint64, in []byte, done func(*http.Response, error)) (*http.Response, error) {
+	var resp Response
+	header := make(http.Header)
+	accept := func(name, value string) {
+		header[name] = append(header[name], value)
+	}
+	var unblocked func(error)
+	if done != nil {
+		unblocked = func(err error) {
+			if err != nil {
+				done(nil, err)
+				return
+			}
+			done(newHTTPResponse(&resp, header))
+		}
+	}
+	err := d.DecodeResponse(streamID, in, &resp, accept, unblocked)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPResponse(&resp, header)
+}
+
+func newHTTPResponse(resp *Response, header http.Header) (*http.Response, error) {
+	contentLength, err := parseContentLength(header)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode),
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/3.0",
+		ProtoMajor:    3,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: contentLength,
+		Trailer:       announcedTrailers(header),
+	}, nil
+}
+
+// parseContentLength returns the Content-Length of header, or -1 if absent.
+// Multiple differing values are malformed.
+// https://www.rfc-editor.org/rfc/rfc9110.html#name-content-length
+func parseContentLength(header http.Header) (int64, error) {
+	values := header["Content-Length"]
+	if len(values) == 0 {
+		return -1, nil
+	}
+	for _, v := range values[1:] {
+		if v != values[0] {
+			return 0, ErrMessage{errors.New("differing Content-Length values")}
+		}
+	}
+	n, err := strconv.ParseUint(values[0], 10, 63)
+	if err != nil {
+		return 0, ErrMessage{fmt.Errorf("invalid Content-Length %q", values[0])}
+	}
+	return int64(n), nil
+}
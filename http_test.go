@@ -0,0 +1,154 @@
+package quack
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestHTTPRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		host       string
+		header     http.Header
+		requestURI string
+	}{
+		{"get", "GET", "https://example.com/index.html?q=1", "", nil, "/index.html?q=1"},
+		{"host", "GET", "https://example.com/", "example.org", nil, "/"},
+		{"options", "OPTIONS", "https://example.com", "", nil, "*"},
+		{"opaque", "GET", "https:/%2F/path", "example.com", nil, "/%2F/path"},
+		{"connect", "CONNECT", "//example.com:443", "", nil, "example.com:443"},
+		{"connection specific", "POST", "https://example.com/", "", http.Header{
+			"Connection":        {"keep-alive"},
+			"Transfer-Encoding": {"chunked"},
+			"Host":              {"example.com"},
+			"X-A":               {"1"},
+		}, "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.name == "opaque" {
+				u = &url.URL{Scheme: "https", Opaque: "/%2F/path"}
+			}
+			r := &http.Request{Method: tt.method, URL: u, Host: tt.host, Header: tt.header, ContentLength: 3}
+
+			p, err := NewEncoder().AppendHTTPRequest(nil, 0, r)
+			if err != nil {
+				t.Fatalf("unexpected encode error %v", err)
+			}
+			got, err := NewDecoder(Strict()).DecodeHTTPRequest(0, p, nil)
+			if err != nil {
+				t.Fatalf("unexpected decode error %v", err)
+			}
+			host := tt.host
+			if host == "" {
+				host = u.Host
+			}
+			if got.Method != tt.method || got.Host != host || got.RequestURI != tt.requestURI {
+				t.Errorf("unexpected request %s %s %s", got.Method, got.Host, got.RequestURI)
+			}
+			if got.ProtoMajor != 3 || got.ContentLength != 3 {
+				t.Errorf("unexpected protocol %d or content length %d", got.ProtoMajor, got.ContentLength)
+			}
+			if tt.method != "CONNECT" && (got.URL.Scheme != "https" || got.URL.Host != host) {
+				t.Errorf("unexpected URL %s", got.URL)
+			}
+			if len(tt.header) > 0 && (len(got.Header) != 2 || got.Header.Get("X-A") != "1") {
+				t.Errorf("unexpected header %v", got.Header)
+			}
+		})
+	}
+}
+
+func TestHTTPResponse(t *testing.T) {
+	header := http.Header{
+		"Content-Length": {"42"},
+		"Connection":     {"close"},
+		"Content-Type":   {"text/plain"},
+	}
+	p, err := NewEncoder().AppendHTTPResponse(nil, 0, http.StatusNotFound, header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	resp, err := NewDecoder(Strict()).DecodeHTTPResponse(0, p, nil)
+	if err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if resp.StatusCode != 404 || resp.Status != "404 Not Found" || resp.ContentLength != 42 {
+		t.Errorf("unexpected response %s %d", resp.Status, resp.ContentLength)
+	}
+	if resp.Header.Get("Connection") != "" || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("unexpected header %v", resp.Header)
+	}
+
+	p, err = NewEncoder().AppendResponse(nil, 0, 200, map[string][]string{"Content-Length": {"1", "2"}})
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	if _, err := NewDecoder().DecodeHTTPResponse(0, p, nil); err == nil {
+		t.Errorf("expected error for differing Content-Length values")
+	}
+}
+
+func TestHTTPTrailers(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder(Strict())
+
+	// As a gRPC handler would, announcing Grpc-Status before the response
+	// header section is written.
+	header := http.Header{
+		"Content-Type": {"application/grpc"},
+		"Trailer":      {"Grpc-Status, grpc-message"},
+	}
+	p, err := e.AppendHTTPResponse(nil, 0, 200, header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	resp, err := d.DecodeHTTPResponse(0, p, nil)
+	if err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if len(resp.Trailer) != 2 {
+		t.Errorf("expected announced trailers, got %v", resp.Trailer)
+	}
+	for _, name := range []string{"Grpc-Status", "Grpc-Message"} {
+		if _, ok := resp.Trailer[name]; !ok {
+			t.Errorf("expected %s trailer announced", name)
+		}
+	}
+
+	header.Set("Grpc-Status", "0")
+	header.Set("Grpc-Message", "OK")
+	header.Set(http.TrailerPrefix+"x-late", "1")
+	p, err = e.AppendHTTPTrailers(nil, 0, header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	trailers, err := d.DecodeHTTPTrailers(0, p, nil)
+	if err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if len(trailers) != 3 || trailers.Get("Grpc-Status") != "0" ||
+		trailers.Get("Grpc-Message") != "OK" || trailers.Get("X-Late") != "1" {
+		t.Errorf("unexpected trailers %v", trailers)
+	}
+
+	// No Date is added to trailers.
+	p, err = e.AppendTrailers(nil, 0, map[string][]string{"Grpc-Status": {"0"}})
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	trailers, err = d.DecodeHTTPTrailers(0, p, nil)
+	if err != nil || len(trailers) != 1 {
+		t.Errorf("unexpected trailers %v, %v", trailers, err)
+	}
+	if _, err := e.AppendTrailersFields(nil, 0, []Field{{Name: ":status", Value: "200"}}); err == nil {
+		t.Errorf("expected error encoding pseudo-header field in trailers")
+	}
+}
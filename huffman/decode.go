@@ -4,6 +4,22 @@ package huffman
 // result. Will return an error if the input is incorrectly padded, or if the
 // EOS code has been encoded.
 func Decode(dst, in []byte) ([]byte, error) {
+	return DecodeMax(dst, in, maxDecodedLength)
+}
+
+// MinDecodedLength returns the fewest bytes n bytes of huffman encoded data
+// can decode to, with every code of the maximum length, and 7 bits of
+// padding.
+func MinDecodedLength(n uint64) uint64 {
+	if n == 0 {
+		return 0
+	}
+	return (8*n - 7) / maxCodeLength
+}
+
+// DecodeMax is Decode, returning ErrDecodedTooLong without decoding further
+// once more than maxLen bytes have been decoded.
+func DecodeMax(dst, in []byte, maxLen uint64) ([]byte, error) {
 	// The maximum code length is 30. Loading 32 or more bits at time, ensures
 	// have atleast one code to decode.
 	var x uint64
@@ -12,8 +28,16 @@ func Decode(dst, in []byte) ([]byte, error) {
 	if len(in) > maxEncodedLength {
 		return dst, errInputTooLong
 	}
+	if MinDecodedLength(uint64(len(in))) > maxLen {
+		return dst, ErrDecodedTooLong
+	}
+	// Output beyond end exceeds maxLen.
+	end := uint64(len(dst)) + min(maxLen, maxDecodedLength)
 
 	for len(in) >= 4 {
+		if uint64(len(dst)) > end {
+			return dst, ErrDecodedTooLong
+		}
 		x <<= 32
 		x |= uint64(in[3]) | uint64(in[2])<<8 | uint64(in[1])<<16 | uint64(in[0])<<24
 		in = in[4:]
@@ -57,6 +81,9 @@ func Decode(dst, in []byte) ([]byte, error) {
 	if m := uint64(1<<(n%64)) - 1; x&m != m {
 		return dst, errExpectedEOS
 	}
+	if uint64(len(dst)) > end {
+		return dst, ErrDecodedTooLong
+	}
 	return dst, nil
 }
 
@@ -24,3 +24,7 @@ func (e errorString) Error() string { return (string)(e) }
 const errExpectedEOS = errorString("huffman: expected EOS")
 const errEOSEncoded = errorString("huffman: EOS encoded")
 const errInputTooLong = errorString("huffman: input too long")
+
+// ErrDecodedTooLong is returned by DecodeMax if the decoded output would
+// exceed the maximum length.
+const ErrDecodedTooLong = errorString("huffman: decoded output too long")
@@ -9,6 +9,7 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -74,6 +75,28 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestDecodeMax(t *testing.T) {
+	encoded := dehex(t, "1c6490b2cd39ba75a29a8f5f6b109b7bf8f3ebdf")
+	if got, err := DecodeMax(nil, encoded, 26); err != nil || string(got) != "abcdefghijklmnopqrstuvwxyz" {
+		t.Errorf("unexpected result %q, %v", got, err)
+	}
+	if _, err := DecodeMax(nil, encoded, 25); err != ErrDecodedTooLong {
+		t.Errorf("expected ErrDecodedTooLong, got %v", err)
+	}
+	// Rejected from the encoded length alone.
+	if _, err := DecodeMax(nil, make([]byte, 1000), 10); err != ErrDecodedTooLong {
+		t.Errorf("expected ErrDecodedTooLong, got %v", err)
+	}
+
+	// MinDecodedLength is a lower bound, even for the longest codes.
+	for _, s := range []string{"", "a", "\x00", "\xff\xfe\xfd", strings.Repeat("\x0a", 100), strings.Repeat("\xfe", 7)} {
+		n := uint64(len(AppendString(nil, s)))
+		if m := MinDecodedLength(n); m > uint64(len(s)) {
+			t.Errorf("expected %d encoded bytes of %q to decode to at least %d, exceeding %d", n, s, m, len(s))
+		}
+	}
+}
+
 func BenchmarkDecode(b *testing.B) {
 	buf := make([]byte, 1024)
 	in := dehex(b, "1c6490b2cd39ba75a29a8f5f6b109b7bf8f3ebdf")
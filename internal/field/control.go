@@ -1,22 +1,26 @@
 package field
 
-// control controls finer details of how a specific headers should be encoded.
-type control uint8
+// Control controls finer details of how a specific field should be encoded.
+type Control uint8
 
 const (
-	// neverIndex header field should never be put in the dynamic table.
-	neverIndex control = 1 << iota
-	// neverHuffman never compress the value field.
-	neverHuffman
+	// NeverIndex field should never be put in the dynamic table.
+	NeverIndex Control = 1 << iota
+	// NeverHuffman never compress the value field.
+	NeverHuffman
 )
 
-func (c control) shouldHuffman() bool { return c&neverHuffman == 0 }
-func (c control) neverIndex() bool    { return c&neverIndex != 0 }
+func (c Control) shouldHuffman() bool { return c&NeverHuffman == 0 }
+func (c Control) neverIndex() bool    { return c&NeverIndex != 0 }
 
-func headerControl(name string) control {
+// Policy returns the Control of a field.
+type Policy func(name, value string) Control
+
+// DefaultPolicy is the Policy used when none is set.
+func DefaultPolicy(name, value string) Control {
 	switch name {
 	case "Authorization", "Content-Md5":
-		return neverIndex | neverHuffman
+		return NeverIndex | NeverHuffman
 	case "Date",
 		"Etag",
 		"If-Modified-Since",
@@ -27,7 +31,20 @@ func headerControl(name string) control {
 		"Range",
 		"Retry-After",
 		"Set-Cookie":
-		return neverIndex
+		return NeverIndex
 	}
 	return 0
 }
+
+// control returns the Control of field f under policy, or DefaultPolicy if
+// nil. Fields marked NeverIndex are never indexed regardless.
+func (policy Policy) control(f Field) Control {
+	if policy == nil {
+		policy = DefaultPolicy
+	}
+	ctrl := policy(f.Name, f.Value)
+	if f.NeverIndex {
+		ctrl |= NeverIndex
+	}
+	return ctrl
+}
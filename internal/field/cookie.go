@@ -0,0 +1,53 @@
+package field
+
+import "strings"
+
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-compressing-the-cookie-head
+
+// EachField calls f for each field of header, in order. Cookie fields are
+// split into separate fields for each cookie-pair, or crumb, to improve
+// compression. Crumbs inherit the NeverIndex of their Cookie field.
+func EachField(header Header, f func(Field)) {
+	header.Fields(func(fl Field) {
+		if fl.Name != "Cookie" {
+			f(fl)
+			return
+		}
+		value := fl.Value
+		crumb, rest, found := strings.Cut(value, "; ")
+		for found {
+			if crumb != "" {
+				fl.Value = crumb
+				f(fl)
+			}
+			crumb, rest, found = strings.Cut(rest, "; ")
+		}
+		if crumb != "" || value == "" {
+			fl.Value = crumb
+			f(fl)
+		}
+	})
+}
+
+// joinCookies wraps accept, collecting the values of Cookie fields rather
+// than passing them on. The returned flush passes the collected values, if
+// any, to accept concatenated as a single Cookie field, never indexed if any
+// of the crumbs were.
+func joinCookies(accept func(Field)) (wrapped func(Field), flush func()) {
+	var crumbs []string
+	var neverIndex bool
+	wrapped = func(fl Field) {
+		if fl.Name == "Cookie" {
+			crumbs = append(crumbs, fl.Value)
+			neverIndex = neverIndex || fl.NeverIndex
+			return
+		}
+		accept(fl)
+	}
+	flush = func() {
+		if len(crumbs) > 0 {
+			accept(Field{Name: "Cookie", Value: strings.Join(crumbs, "; "), NeverIndex: neverIndex})
+		}
+	}
+	return wrapped, flush
+}
@@ -0,0 +1,64 @@
+package field
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestCookieCrumbs(t *testing.T) {
+	tests := []struct {
+		cookie string
+		crumbs []string
+	}{
+		{"", []string{""}},
+		{"a=1", []string{"a=1"}},
+		{"a=1; b=2; c=3", []string{"a=1", "b=2", "c=3"}},
+		{"a=1;b=2", []string{"a=1;b=2"}},
+		{"a=1; ; b=2; ", []string{"a=1", "b=2"}},
+	}
+	for _, tt := range tests {
+		var crumbs []string
+		EachField(Map{"Cookie": {tt.cookie}}, func(f Field) {
+			crumbs = append(crumbs, f.Value)
+		})
+		if !slices.Equal(crumbs, tt.crumbs) {
+			t.Errorf("expected %q to crumble into %q, got %q", tt.cookie, tt.crumbs, crumbs)
+		}
+	}
+}
+
+func TestCookieRoundTrip(t *testing.T) {
+	var dt DT
+	dt.SetMaxCapacity(4096)
+	dt.AppendSetCapacity(nil, 4096)
+
+	header := List{
+		{Name: "Cookie", Value: "a=1; b=2"},
+		{Name: "Accept", Value: "*/*"},
+		{Name: "Cookie", Value: "c=3"},
+	}
+	_, fe := dt.AppendEncoderInstructions(nil, header)
+	if n := len(fe.nv["Cookie"]); n != 3 {
+		t.Errorf("expected 3 cookie crumbs inserted, got %d", n)
+	}
+	s := &Section{Limit: fe.InsertCount()}
+	p := fe.AppendRequest(nil, s, "GET", "https", "example.com", "/", header)
+
+	var fields []Field
+	err := dt.Decoder().Decode(p, math.MaxUint64, func(f Field) {
+		if f.Name[0] != ':' {
+			fields = append(fields, f)
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []Field{
+		{Name: "Accept", Value: "*/*"},
+		{Name: "Cookie", Value: "a=1; b=2; c=3"},
+	}
+	if !slices.Equal(fields, expected) {
+		t.Errorf("expected %v, got %v", expected, fields)
+	}
+}
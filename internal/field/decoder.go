@@ -2,6 +2,8 @@ package field
 
 import (
 	"errors"
+	"fmt"
+	"math/bits"
 
 	"github.com/renthraysk/quack/ascii"
 	"github.com/renthraysk/quack/huffman"
@@ -9,21 +11,51 @@ import (
 )
 
 var (
-	errUnexpectedEnd         = errors.New("unexpected end")
-	errUnexpectedTypeByte    = errors.New("unexpected type byte 0b000X_XXXX")
-	errStaticIndexOutOfRange = errors.New("static index out of range")
-	errNameInvalid           = errors.New("invalid name")
-	errValueInvalid          = errors.New("invalid value")
+	errUnexpectedEnd          = errors.New("unexpected end")
+	errUnexpectedTypeByte     = errors.New("unexpected type byte 0b000X_XXXX")
+	errStaticIndexOutOfRange  = errors.New("static index out of range")
+	errNameInvalid            = errors.New("invalid name")
+	errValueInvalid           = errors.New("invalid value")
+	errInvalidBase            = errors.New("invalid base")
+	errDynamicIndexOutOfRange = errors.New("dynamic index out of range")
+	errDynamicIndexEvicted    = errors.New("dynamic index evicted")
+	errNameUppercase          = fmt.Errorf("%w: uppercase name", ErrMalformed)
 )
 
+// ErrMalformed is wrapped by errors for field sections that decode, but are
+// malformed HTTP/3 messages.
+var ErrMalformed = errors.New("malformed")
+
+// ErrFieldSectionTooLarge is returned when a decoded field section exceeds the
+// maximum field section size.
+var ErrFieldSectionTooLarge = errors.New("field section too large")
+
+// ErrBlocked is returned when a field section references dynamic table entries
+// the decoder has yet to receive.
+var ErrBlocked = errors.New("required insert count exceeds insert count")
+
+// Decoder field line decoder, immutable once created
 type Decoder struct {
+	// headers is a copy of the dynamic table entries, oldest first.
+	headers []header
+	// evicted is the absolute index of headers[0].
+	evicted     uint64
 	insertCount uint64
-	capacity    uint64
+	maxCapacity uint64
+	// strict rejects uppercase literal names.
+	strict bool
+	// uppercase holds the absolute indices of entries with names containing
+	// uppercase characters, if strict.
+	uppercase map[uint64]struct{}
 }
 
 // https://datatracker.ietf.org/doc/html/rfc9204#name-encoded-field-section-prefi
 func (d *Decoder) readFieldSectionPrefix(p []byte) ([]byte, uint64, uint64, error) {
-	var reqInsertCount uint64
+	var reqInsertCount, insertCount, maxCapacity uint64
+
+	if d != nil {
+		insertCount, maxCapacity = d.insertCount, d.maxCapacity
+	}
 
 	encodedInsertCount, q, err := varint.Read(p, 0xFF)
 	if err != nil {
@@ -31,13 +63,13 @@ func (d *Decoder) readFieldSectionPrefix(p []byte) ([]byte, uint64, uint64, erro
 	}
 	// https://datatracker.ietf.org/doc/html/rfc9204#name-required-insert-count
 	if encodedInsertCount != 0 {
-		maxEntries := d.capacity / 32
+		maxEntries := maxCapacity / 32
 
 		fullRange := 2 * maxEntries
 		if encodedInsertCount > fullRange {
 			return p, 0, 0, errors.New("encodedInsertCount > fullRange")
 		}
-		maxValue := d.insertCount + maxEntries
+		maxValue := insertCount + maxEntries
 		maxWrapped := (maxValue / fullRange) * fullRange
 		reqInsertCount = maxWrapped + encodedInsertCount - 1
 		if reqInsertCount > maxValue {
@@ -63,21 +95,79 @@ func (d *Decoder) readFieldSectionPrefix(p []byte) ([]byte, uint64, uint64, erro
 
 	base := reqInsertCount + deltaBase
 	if q[0]&S != 0 {
+		if deltaBase >= reqInsertCount {
+			return p, 0, 0, errInvalidBase
+		}
 		base = reqInsertCount - deltaBase - 1
 	}
+	if reqInsertCount > insertCount {
+		return p, reqInsertCount, base, ErrBlocked
+	}
 	return r, reqInsertCount, base, nil
 }
 
-// Decode decodes the header fields in p.
-func (d *Decoder) Decode(p []byte, accept func(string, string)) error {
+// InsertCount returns the number of dynamic table inserts the decoder has
+// received.
+func (d *Decoder) InsertCount() uint64 {
+	if d == nil {
+		return 0
+	}
+	return d.insertCount
+}
+
+// RequiredInsertCount returns the Required Insert Count of the field section
+// in p.
+func (d *Decoder) RequiredInsertCount(p []byte) (uint64, error) {
+	_, reqInsertCount, _, err := d.readFieldSectionPrefix(p)
+	if err == ErrBlocked {
+		err = nil
+	}
+	return reqInsertCount, err
+}
+
+// sectionSize tracks the size of a field section being decoded against the
+// maximum permitted.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-header-size-constraints
+type sectionSize struct {
+	size    uint64
+	maxSize uint64
+}
+
+// remaining returns the length a field line's value may have, given a name
+// of length n, without exceeding the maximum size.
+func (s *sectionSize) remaining(n int) uint64 {
+	used := s.size + 32 + uint64(n)
+	if used >= s.maxSize {
+		return 0
+	}
+	return s.maxSize - used
+}
+
+// add adds the size of a field line, returning ErrFieldSectionTooLarge if
+// the maximum size is exceeded.
+func (s *sectionSize) add(name, value string) error {
+	s.size += headerSize(name, value)
+	if s.size > s.maxSize {
+		return ErrFieldSectionTooLarge
+	}
+	return nil
+}
+
+// Decode decodes the header fields in p. Decoding stops, returning
+// ErrFieldSectionTooLarge, once the field section exceeds maxSize, before
+// allocating the literal that would exceed it. Cookie fields are recombined
+// into a single Cookie field, passed to accept last. Fields of literal field
+// lines are passed with the never-index bit of their representation.
+func (d *Decoder) Decode(p []byte, maxSize uint64, accept func(Field)) error {
 
 	q, reqInsertCount, base, err := d.readFieldSectionPrefix(p)
 	if err != nil {
 		return err
 	}
-	_, _ = reqInsertCount, base
-
+	accept, flushCookies := joinCookies(accept)
+	strict := d != nil && d.strict
 	buf := make([]byte, 0, 256) // Huffman decode scratch buffer
+	size := sectionSize{maxSize: maxSize}
 
 	for len(q) > 0 {
 		switch (q[0] >> 4) & 0b1111 { // & 0b1111 should be unnecessary
@@ -90,16 +180,19 @@ func (d *Decoder) Decode(p []byte, accept func(string, string)) error {
 			if err != nil {
 				return err
 			}
-			value, r, err := readStringLiteral(r, buf)
+			h, err := d.postBase(reqInsertCount, base, index)
 			if err != nil {
 				return err
 			}
-			name, err := d.baseNameIndex(index)
+			value, r, err := readStringLiteral(r, buf, size.remaining(len(h.name)))
 			if err != nil {
 				return err
 			}
+			if err := size.add(h.name, value); err != nil {
+				return err
+			}
+			accept(Field{Name: h.name, Value: value, NeverIndex: q[0]&NeverIndex != 0})
 			q = r
-			accept(name, value)
 
 		case 0b0001:
 			// 0001_XXXX Indexed Field Line with Post-Base Index
@@ -108,50 +201,62 @@ func (d *Decoder) Decode(p []byte, accept func(string, string)) error {
 			if err != nil {
 				return err
 			}
-			name, value, err := d.baseLineIndex(index)
+			h, err := d.postBase(reqInsertCount, base, index)
 			if err != nil {
 				return err
 			}
+			if err := size.add(h.name, h.value); err != nil {
+				return err
+			}
 			q = r
-			accept(name, value)
+			accept(Field{Name: h.name, Value: h.value})
 
 		case 0b0010, 0b0011:
 			// 001N_HXXX Literal Field Line with Literal Name
 			// https://www.rfc-editor.org/rfc/rfc9204.html#name-literal-field-line-with-lit
+			const NeverIndex = 0b0001_0000
 
-			name, r, err := readLiteralName(q, buf)
+			name, r, err := readLiteralName(q, buf, size.remaining(0), strict)
 			if err != nil {
 				return err
 			}
-			value, r, err := readStringLiteral(r, buf)
+			value, r, err := readStringLiteral(r, buf, size.remaining(len(name)))
 			if err != nil {
 				return err
 			}
+			if err := size.add(name, value); err != nil {
+				return err
+			}
+			accept(Field{Name: name, Value: value, NeverIndex: q[0]&NeverIndex != 0})
 			q = r
-			accept(name, value)
 
 		case 0b0100, 0b0110:
 			// 01N0_XXXX: Literal Field Line with Name Reference in dynamic table
 			// https://www.rfc-editor.org/rfc/rfc9204.html#name-literal-field-line-with-nam
+			const NeverIndex = 0b0010_0000
 
 			index, r, err := varint.Read(q, 0b0000_1111)
 			if err != nil {
 				return err
 			}
-			name, err := d.nameIndex(index)
+			h, err := d.relative(reqInsertCount, base, index)
 			if err != nil {
 				return err
 			}
-			value, r, err := readStringLiteral(r, buf)
+			value, r, err := readStringLiteral(r, buf, size.remaining(len(h.name)))
 			if err != nil {
 				return err
 			}
+			if err := size.add(h.name, value); err != nil {
+				return err
+			}
+			accept(Field{Name: h.name, Value: value, NeverIndex: q[0]&NeverIndex != 0})
 			q = r
-			accept(name, value)
 
 		case 0b0101, 0b0111:
 			// 01N1_XXXX: Literal Field Line with Name Reference in static table
 			// https://www.rfc-editor.org/rfc/rfc9204.html#name-literal-field-line-with-nam
+			const NeverIndex = 0b0010_0000
 
 			index, r, err := varint.Read(q, 0b0000_1111)
 			if err != nil {
@@ -160,12 +265,16 @@ func (d *Decoder) Decode(p []byte, accept func(string, string)) error {
 			if index >= uint64(len(staticTable)) {
 				return errStaticIndexOutOfRange
 			}
-			value, r, err := readStringLiteral(r, buf)
+			name := staticTable[index].name
+			value, r, err := readStringLiteral(r, buf, size.remaining(len(name)))
 			if err != nil {
 				return err
 			}
+			if err := size.add(name, value); err != nil {
+				return err
+			}
+			accept(Field{Name: name, Value: value, NeverIndex: q[0]&NeverIndex != 0})
 			q = r
-			accept(staticTable[index].name, value)
 
 		case 0b1000, 0b1001, 0b1010, 0b1011:
 			// 10XX_XXXX Indexed Field Line in dynamic table
@@ -174,12 +283,15 @@ func (d *Decoder) Decode(p []byte, accept func(string, string)) error {
 			if err != nil {
 				return err
 			}
-			name, value, err := d.lineIndex(index)
+			h, err := d.relative(reqInsertCount, base, index)
 			if err != nil {
 				return err
 			}
+			if err := size.add(h.name, h.value); err != nil {
+				return err
+			}
 			q = r
-			accept(name, value)
+			accept(Field{Name: h.name, Value: h.value})
 
 		case 0b1100, 0b1101, 0b1110, 0b1111:
 			// 11XX_XXXX Indexed Field Line in static table
@@ -191,32 +303,61 @@ func (d *Decoder) Decode(p []byte, accept func(string, string)) error {
 			if index >= uint64(len(staticTable)) {
 				return errStaticIndexOutOfRange
 			}
+			h := staticTable[index]
+			if err := size.add(h.name, h.value); err != nil {
+				return err
+			}
 			q = r
-			accept(staticTable[index].name, staticTable[index].value)
+			accept(Field{Name: h.name, Value: h.value})
 		}
 	}
+	flushCookies()
 	return nil
 }
 
-func (d *Decoder) nameIndex(index uint64) (string, error) {
-	return "", errors.New("TODO unsupported")
-}
-
-func (d *Decoder) baseNameIndex(index uint64) (string, error) {
-	return "", errors.New("TODO unsupported")
+// relative returns the dynamic table entry at relative index, relative to
+// base.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-relative-indexing
+func (d *Decoder) relative(reqInsertCount, base, index uint64) (header, error) {
+	if index >= base {
+		return header{}, errDynamicIndexOutOfRange
+	}
+	return d.absolute(reqInsertCount, base-index-1)
 }
 
-func (d *Decoder) lineIndex(index uint64) (string, string, error) {
-	return "", "", errors.New("TODO unsupported")
+// postBase returns the dynamic table entry at post-base index, relative to
+// base.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-post-base-indexing
+func (d *Decoder) postBase(reqInsertCount, base, index uint64) (header, error) {
+	abs, c := bits.Add64(base, index, 0)
+	if c != 0 {
+		return header{}, errDynamicIndexOutOfRange
+	}
+	return d.absolute(reqInsertCount, abs)
 }
 
-func (d *Decoder) baseLineIndex(index uint64) (string, string, error) {
-	return "", "", errors.New("TODO unsupported")
+// absolute returns the dynamic table entry at absolute index abs. Entries at
+// or beyond the Required Insert Count of the field section may not be
+// referenced.
+func (d *Decoder) absolute(reqInsertCount, abs uint64) (header, error) {
+	if abs >= reqInsertCount {
+		return header{}, errDynamicIndexOutOfRange
+	}
+	// reqInsertCount <= d.insertCount so abs indexes a received entry.
+	if abs < d.evicted {
+		return header{}, errDynamicIndexEvicted
+	}
+	if _, ok := d.uppercase[abs]; ok {
+		return header{}, errNameUppercase
+	}
+	return d.headers[abs-d.evicted], nil
 }
 
 // readLiteralName reads a literal name from p. Will use decodeBuf if the
-// string needs to be huffman decoded.
-func readLiteralName(p, decodeBuf []byte) (string, []byte, error) {
+// string needs to be huffman decoded. Returns ErrFieldSectionTooLarge if the
+// name is longer than maxLen. If strict, names containing uppercase
+// characters are malformed.
+func readLiteralName(p, decodeBuf []byte, maxLen uint64, strict bool) (string, []byte, error) {
 	const (
 		// layout of the first byte of a literal name length
 		P = 0b0010_0000
@@ -234,32 +375,51 @@ func readLiteralName(p, decodeBuf []byte) (string, []byte, error) {
 	if n > uint64(len(q)) {
 		return "", p, errUnexpectedEnd
 	}
-	b := q[:n:n]
-	if p[0]&H != 0 {
-		b, err = huffman.Decode(decodeBuf[:0], b)
-		if err != nil {
-			return "", p, err
-		}
+	b, err := decodeLiteral(q[:n:n], decodeBuf, p[0]&H != 0, maxLen)
+	if err != nil {
+		return "", p, err
+	}
+	name, uppercase, err := canonicalName(b, decodeBuf)
+	if err != nil {
+		return "", p, err
+	}
+	if strict && uppercase {
+		return "", p, errNameUppercase
+	}
+	return name, q[n:], nil
+}
+
+// canonicalName validates literal name b, returning its canonical form, and
+// whether it contains uppercase characters, which HTTP/3 prohibits. Names of
+// pseudo-header fields absent from the static table, such as :protocol, keep
+// their leading ':'. Canonicalised in decodeBuf, which b may already occupy,
+// so the input is left unmodified.
+func canonicalName(b, decodeBuf []byte) (string, bool, error) {
+	name := b
+	if len(name) > 0 && name[0] == ':' {
+		name = name[1:]
 	}
 	// Don't allocate for obvious garbage.
-	if !ascii.IsNameValid(b) {
-		return "", p, errNameInvalid
+	if !ascii.IsNameValid(name) {
+		return "", false, errNameInvalid
 	}
-	return ascii.ToCanonical(b), q[n:], nil // Allocation
+	uppercase := !ascii.IsName3Valid(name)
+	return ascii.ToCanonical(append(decodeBuf[:0], b...)), uppercase, nil // Allocation
 }
 
 // readStringLiteral reads a string literal from p. Will use decodeBuf if the
-// string needs to be huffman decoded.
-func readStringLiteral(p, decodeBuf []byte) (string, []byte, error) {
+// string needs to be huffman decoded. Returns ErrFieldSectionTooLarge if the
+// string is longer than maxLen.
+func readStringLiteral(p, decodeBuf []byte, maxLen uint64) (string, []byte, error) {
 	const (
 		// layout of the first byte of a string literal length
 		H = 0b1000_0000
 		M = 0b0111_1111
 	)
-	return readLiteral(p, decodeBuf, M, H)
+	return readLiteral(p, decodeBuf, M, H, maxLen)
 }
 
-func readLiteral(p, decodeBuf []byte, m, h uint8) (string, []byte, error) {
+func readLiteral(p, decodeBuf []byte, m, h uint8, maxLen uint64) (string, []byte, error) {
 	if len(p) <= 0 {
 		return "", p, errUnexpectedEnd
 	}
@@ -270,12 +430,9 @@ func readLiteral(p, decodeBuf []byte, m, h uint8) (string, []byte, error) {
 	if n > uint64(len(q)) {
 		return "", p, errUnexpectedEnd
 	}
-	b := q[:n:n]
-	if p[0]&h == h {
-		b, err = huffman.Decode(decodeBuf[:0], b)
-		if err != nil {
-			return "", p, err
-		}
+	b, err := decodeLiteral(q[:n:n], decodeBuf, p[0]&h == h, maxLen)
+	if err != nil {
+		return "", p, err
 	}
 	// Don't allocate for obvious garbage.
 	if !ascii.IsValueValid(b) {
@@ -283,3 +440,20 @@ func readLiteral(p, decodeBuf []byte, m, h uint8) (string, []byte, error) {
 	}
 	return string(b), q[n:], nil // Allocation
 }
+
+// decodeLiteral returns the string literal b, huffman decoded into decodeBuf
+// if isHuffman. Returns ErrFieldSectionTooLarge, without decoding beyond it,
+// if the literal is longer than maxLen.
+func decodeLiteral(b, decodeBuf []byte, isHuffman bool, maxLen uint64) ([]byte, error) {
+	if !isHuffman {
+		if uint64(len(b)) > maxLen {
+			return nil, ErrFieldSectionTooLarge
+		}
+		return b, nil
+	}
+	b, err := huffman.DecodeMax(decodeBuf[:0], b, maxLen)
+	if err == huffman.ErrDecodedTooLong || uint64(len(b)) > maxLen {
+		return nil, ErrFieldSectionTooLarge
+	}
+	return b, err
+}
@@ -2,42 +2,129 @@ package field
 
 import (
 	"errors"
+	"math"
 	"math/bits"
+	"slices"
 	"sync"
 	"sync/atomic"
 
-	"github.com/renthraysk/quack/ascii"
 	"github.com/renthraysk/quack/huffman"
 	"github.com/renthraysk/quack/internal/inst"
 	"github.com/renthraysk/quack/varint"
 )
 
+var (
+	errZeroIncrement           = errors.New("insert count increment of zero")
+	errIncrementExceedsInserts = errors.New("insert count increment exceeds inserts")
+)
+
+// drainingDivisor determines the size of the draining region, the oldest
+// entries that would be evicted by inserting capacity/drainingDivisor bytes.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-avoiding-prohibited-inserti
+const drainingDivisor = 4
+
 type DT struct {
-	mu           sync.Mutex
-	headers      []header
-	fieldEncoder *Encoder
-	evicted      uint64
-	size         uint64
-	capacity     uint64
-	maxCapacity  uint64
+	mu          sync.Mutex
+	headers     []header
+	evicted     uint64
+	size        uint64
+	capacity    uint64
+	maxCapacity uint64
+
+	// Decoder only state
+
+	// strict rejects uppercase literal names.
+	strict bool
+	// uppercase holds the absolute indices of entries inserted with names
+	// containing uppercase characters, if strict. Copied on write.
+	uppercase map[uint64]struct{}
+
+	// Encoder only state
+
+	// knownReceivedCount is the number of inserts the peer's decoder is known
+	// to have received.
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-known-received-count
+	knownReceivedCount uint64
+	// refs counts the references to each entry of headers from field
+	// sections yet to be acknowledged.
+	refs []*refCount
+	// policy decides which fields are never indexed or Huffman encoded,
+	// DefaultPolicy if nil.
+	policy Policy
+	// limits restrict inserts, to mitigate guessing attacks.
+	limits InsertLimits
+	// inserts holds the distinct values inserted of each name, if limited.
+	inserts map[string]map[string]struct{}
+	// churned are the names with more than limits.MaxInserts inserts, so
+	// encoded as never indexed literals. Copied on write.
+	churned map[string]struct{}
+	// encoder is the Encoder of the current state, nil once stale.
+	encoder *Encoder
+}
+
+// refCount counts the references to a dynamic table entry from field
+// sections yet to be acknowledged. Field sections encode concurrently with
+// changes to the dynamic table, so once an entry is evicted the count is set
+// negative, causing any further attempt to reference it to fail.
+type refCount struct {
+	n atomic.Int64
+}
+
+// acquire increments the reference count, returning false if the entry has
+// been evicted.
+func (rc *refCount) acquire() bool {
+	for {
+		n := rc.n.Load()
+		if n < 0 {
+			return false
+		}
+		if rc.n.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
 }
 
+func (rc *refCount) release() { rc.n.Add(-1) }
+
+// evict marks the entry as evicted, returning false if it is referenced.
+func (rc *refCount) evict() bool { return rc.n.CompareAndSwap(0, -1) }
+
 func (dt *DT) insertCountLocked() uint64 {
 	return dt.evicted + uint64(len(dt.headers))
 }
 
 func (dt *DT) headerFromRelativePosLocked(rel uint64) (header, bool) {
-	abs := dt.insertCountLocked() - rel - 1
-	if abs >= uint64(len(dt.headers)) {
+	if rel >= uint64(len(dt.headers)) {
 		return header{}, false
 	}
-	return dt.headers[abs], true
+	return dt.headers[uint64(len(dt.headers))-rel-1], true
+}
+
+// SetStrict has the dynamic table, and its Decoders, reject literal names
+// containing uppercase characters, which HTTP/3 prohibits. Inserts of such
+// names are accepted, as the encoder stream is not at fault, but field
+// sections referencing them are malformed.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-fields
+func (dt *DT) SetStrict() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.strict = true
+}
+
+// SetPolicy sets the Policy of the dynamic table, and its Encoders, deciding
+// which fields are never indexed or Huffman encoded.
+func (dt *DT) SetPolicy(policy Policy) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.policy = policy
+	dt.encoder = nil
 }
 
-func (dt *DT) setMaxCapacity(maxCapacity uint64) {
+func (dt *DT) SetMaxCapacity(maxCapacity uint64) {
 	dt.mu.Lock()
 	defer dt.mu.Unlock()
 	dt.maxCapacity = maxCapacity
+	dt.encoder = nil
 	if dt.capacity > maxCapacity {
 		dt.setCapacityLocked(maxCapacity)
 	}
@@ -49,21 +136,107 @@ func (dt *DT) setCapacityLocked(capacity uint64) bool {
 	}
 	if dt.evictLocked(capacity) {
 		dt.capacity = capacity
+		dt.encoder = nil
 		return true
 	}
 	return false
 }
 
-func (dt *DT) changeEncoder(p *atomic.Pointer[Encoder], knownReceivedCount uint64) error {
-	/* TODO */
-	return nil
+// AppendSetCapacity appends a Set Dynamic Table Capacity instruction to p if
+// the dynamic table capacity can be changed to capacity. Returns false if
+// capacity exceeds the maximum capacity, or would require evicting entries
+// that are not evictable.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-set-dynamic-table-capacity
+func (dt *DT) AppendSetCapacity(p []byte, capacity uint64) ([]byte, bool) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	if capacity == dt.capacity {
+		return p, true
+	}
+	if !dt.canEvictLocked(capacity) || !dt.setCapacityLocked(capacity) {
+		return p, false
+	}
+	return inst.AppendSetDynamicTableCapacity(p, capacity), true
 }
 
-func (dt *DT) changeDecoder(p *atomic.Pointer[Decoder], knownReceivedCount uint64) error {
-	/* TODO */
+// Decoder returns a snapshot of the dynamic table for decoding field sections.
+func (dt *DT) Decoder() *Decoder {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	return &Decoder{
+		headers:     slices.Clone(dt.headers),
+		evicted:     dt.evicted,
+		insertCount: dt.insertCountLocked(),
+		maxCapacity: dt.maxCapacity,
+		strict:      dt.strict,
+		uppercase:   dt.uppercase,
+	}
+}
+
+// KnownReceivedCount returns the number of inserts the peer's decoder is known
+// to have received.
+func (dt *DT) KnownReceivedCount() uint64 {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.knownReceivedCount
+}
+
+// Acknowledge updates the Known Received Count upon acknowledgement of a field
+// section with Required Insert Count reqInsertCount.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-section-acknowledgment
+func (dt *DT) Acknowledge(reqInsertCount uint64) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if reqInsertCount > dt.knownReceivedCount {
+		dt.knownReceivedCount = reqInsertCount
+		dt.encoder = nil
+	}
+}
+
+// Increment increases the Known Received Count by increment. An increment of
+// zero, or one beyond the number of inserts made is an error.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-insert-count-increment
+func (dt *DT) Increment(increment uint64) error {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	if increment == 0 {
+		return errZeroIncrement
+	}
+	if increment > dt.insertCountLocked()-dt.knownReceivedCount {
+		return errIncrementExceedsInserts
+	}
+	dt.knownReceivedCount += increment
+	dt.encoder = nil
 	return nil
 }
 
+// isEvictableLocked returns true if the entry at headers[i] can be evicted.
+// The insertion must have been acknowledged, and no unacknowledged field
+// sections reference it.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-insertion-and
+func (dt *DT) isEvictableLocked(i int) bool {
+	return dt.evicted+uint64(i) < dt.knownReceivedCount && dt.refs[i].n.Load() == 0
+}
+
+// canEvictLocked returns true if the entries that require eviction to reduce
+// the dynamic table size to targetSize are all evictable.
+func (dt *DT) canEvictLocked(targetSize uint64) bool {
+	size := dt.size
+	for i, hf := range dt.headers {
+		if size <= targetSize {
+			return true
+		}
+		if !dt.isEvictableLocked(i) {
+			return false
+		}
+		size -= hf.size()
+	}
+	return size <= targetSize
+}
+
 // evictLocked attempts to evict field.Headers until size is less than or equal to
 // targetSize. Returns true if was able to ensure the dynamic table size
 // is or below targetSize, false otherwise.
@@ -75,20 +248,31 @@ func (dt *DT) evictLocked(targetSize uint64) bool {
 		size -= dt.headers[i].size()
 		i++
 	}
+	if size > targetSize {
+		return false
+	}
 	if i == 0 {
 		return true
 	}
-	if i >= len(dt.headers) {
-		return false
-	}
 	evicted, c := bits.Add64(dt.evicted, uint64(i), 0)
 	if c != 0 {
 		return false
 	}
+	// Claim the entries, failing if a field section has since referenced
+	// one.
+	for j, rc := range dt.refs[:i] {
+		if !rc.evict() {
+			for _, rc := range dt.refs[:j] {
+				rc.n.Store(0)
+			}
+			return false
+		}
+	}
 	// Eviction can proceed, modify state.
 	dt.evicted = evicted
 	dt.size = size
 	dt.headers = append(dt.headers[:0], dt.headers[i:]...)
+	dt.refs = append(dt.refs[:0], dt.refs[i:]...)
 	return true
 }
 
@@ -104,6 +288,8 @@ func (dt *DT) insertLocked(name, value string) bool {
 	// This addition cannot overflow as dt.size <= dt.capacity - s
 	dt.size += s
 	dt.headers = append(dt.headers, header{name: name, value: value})
+	dt.refs = append(dt.refs, new(refCount))
+	dt.encoder = nil
 	return true
 }
 
@@ -133,60 +319,146 @@ func (dt *DT) appendSnapshot(p []byte) []byte {
 	return p
 }
 
+// decodeNameInsertWithLiteralName returns the canonical name of an Insert
+// with Literal Name, and whether it contains uppercase characters.
 // https://www.rfc-editor.org/rfc/rfc9204.html#name-insert-with-literal-name
-func decodeNameInsertWithLiteralName(p, buf []byte) (string, []byte, error) {
+func decodeNameInsertWithLiteralName(p, buf []byte) (string, bool, []byte, error) {
 	const H = 0b0010_0000
 	const M = 0b0001_1111
 
 	n, q, err := varint.Read(p, M)
 	if err != nil {
-		return "", p, err
+		return "", false, p, err
 	}
 	if n > uint64(len(q)) {
-		return "", p, errors.New("")
+		return "", false, p, errUnexpectedEnd
 	}
 	b := q[:n]
 	if p[0]&H != 0 {
 		b, err = huffman.Decode(buf[:0], b)
 		if err != nil {
-			return "", p, err
+			return "", false, p, err
 		}
 	}
-	if !ascii.IsName3Valid(b) {
+	name, uppercase, err := canonicalName(b, buf)
+	if err != nil {
+		return "", false, p, err
+	}
+	return name, uppercase, q[n:], nil
+}
+
+// markUppercaseLocked records the most recent insert as having a name with
+// uppercase characters, dropping the indices of evicted entries.
+func (dt *DT) markUppercaseLocked() {
+	uppercase := make(map[uint64]struct{}, len(dt.uppercase)+1)
+	for abs := range dt.uppercase {
+		if abs >= dt.evicted {
+			uppercase[abs] = struct{}{}
+		}
 	}
-	return ascii.ToCanonical(b), q[n:], nil
+	uppercase[dt.insertCountLocked()-1] = struct{}{}
+	dt.uppercase = uppercase
 }
 
 // https://www.rfc-editor.org/rfc/rfc9204.html#name-insert-with-name-reference
-func (dt *DT) decodeNameInsertWithNameReference(p []byte) (string, []byte, error) {
+func (dt *DT) decodeNameInsertWithNameReference(p []byte) (string, bool, []byte, error) {
 	const T = 0b0100_0000
 	const M = 0b0011_1111
 
 	i, q, err := varint.Read(p, M)
 	if err != nil {
-		return "", p, err
+		return "", false, p, err
 	}
 	if p[0]&T != 0 {
 		if i >= uint64(len(staticTable)) {
-			return "", p, errors.New("invalid static table index")
+			return "", false, p, errors.New("invalid static table index")
 		}
-		return staticTable[i].name, q, nil
+		return staticTable[i].name, false, q, nil
 	}
 	h, ok := dt.headerFromRelativePosLocked(i)
 	if !ok {
-		return "", p, errors.New("invalid dynamic table index")
+		return "", false, p, errors.New("invalid dynamic table index")
 	}
-	return h.name, q, nil
+	return h.name, dt.isUppercaseLocked(i), q, nil
+}
+
+// isUppercaseLocked returns true if the entry at relative index rel was
+// marked as having a name with uppercase characters.
+func (dt *DT) isUppercaseLocked(rel uint64) bool {
+	_, ok := dt.uppercase[dt.insertCountLocked()-rel-1]
+	return ok
 }
 
-func (dt *DT) appendEncoderInstructionLocked(p []byte, name, value string) []byte {
-	i, isStatic, m := dt.fieldEncoder.lookup(name, value)
+// drainLocked returns the absolute index of the oldest entry outside of the
+// draining region. Entries in the draining region are close to eviction, so
+// are not referenced by field sections, to avoid them blocking inserts.
+func (dt *DT) drainLocked() uint64 {
+	room := dt.capacity - dt.size
+	for i, hf := range dt.headers {
+		if room >= dt.capacity/drainingDivisor {
+			return dt.evicted + uint64(i)
+		}
+		room += hf.size()
+	}
+	return dt.insertCountLocked()
+}
+
+// lookupLocked searches the dynamic table for the most recently inserted
+// entry matching name and value, returning its absolute index.
+func (dt *DT) lookupLocked(name, value string) (abs uint64, m match) {
+	for i := len(dt.headers) - 1; i >= 0; i-- {
+		if hf := dt.headers[i]; hf.name == name {
+			if hf.value == value {
+				return dt.evicted + uint64(i), matchNameValue
+			}
+			if m == matchNone {
+				abs, m = dt.evicted+uint64(i), matchName
+			}
+		}
+	}
+	return abs, m
+}
+
+// canInsertLocked returns true if an entry of size s can be inserted without
+// evicting entries the peer's decoder may still require.
+func (dt *DT) canInsertLocked(s uint64) bool {
+	return s <= dt.capacity && dt.canEvictLocked(dt.capacity-s)
+}
+
+// appendEncoderInstructionLocked appends the encoder instruction, if any, to
+// insert f into the dynamic table. Of never indexed fields, fields of churned
+// names, and values too short under the insert limits, only the name is
+// inserted.
+func (dt *DT) appendEncoderInstructionLocked(p []byte, f Field) []byte {
+	if dt.isChurnedLocked(f.Name) {
+		f.NeverIndex = true
+	}
+	name, value := f.Name, f.Value
+	i, m := staticLookup(name, value)
+	isStatic := true
+	if m != matchNameValue {
+		if abs, dm := dt.lookupLocked(name, value); dm > m {
+			i, m, isStatic = abs, dm, false
+		}
+	}
 	if m == matchNameValue {
-		// @TODO Duplicate?
-		return p
+		if f.NeverIndex || isStatic || i >= dt.drainLocked() {
+			return p
+		}
+		// Entry is draining, so duplicate it to keep it referenceable.
+		// https://www.rfc-editor.org/rfc/rfc9204.html#name-duplicate
+		if !dt.canInsertLocked(headerSize(name, value)) {
+			return p
+		}
+		rel := dt.insertCountLocked() - i - 1
+		if ok := dt.insertLocked(name, value); !ok {
+			return p
+		}
+		return inst.AppendDuplicate(p, rel)
 	}
-	ctrl := headerControl(name)
-	if ctrl.neverIndex() {
+	ctrl := dt.policy.control(f)
+	nameOnly := ctrl.neverIndex() || uint64(len(value)) < dt.limits.MinValueLength
+	if nameOnly {
 		// If already have a name match, no point attempting an insert
 		// if prevented from inserting a (name, value) pair.
 		if m == matchName {
@@ -194,9 +466,21 @@ func (dt *DT) appendEncoderInstructionLocked(p []byte, name, value string) []byt
 		}
 		value = ""
 	}
+	// Never evict entries the peer's decoder may still require, instead the
+	// field line will be encoded as a literal.
+	if !dt.permitInsertLocked(name) || !dt.canInsertLocked(headerSize(name, value)) {
+		return p
+	}
+	// Relative index of a name reference, prior to the insert.
+	if !isStatic {
+		i = dt.insertCountLocked() - i - 1
+	}
 	if ok := dt.insertLocked(name, value); !ok {
 		return p
 	}
+	if !nameOnly {
+		dt.insertedLocked(name, value)
+	}
 	// successful insertion into dynamic table, so need an encoder
 	// instruction to inform peer
 	switch m {
@@ -208,95 +492,152 @@ func (dt *DT) appendEncoderInstructionLocked(p []byte, name, value string) []byt
 	return inst.AppendStringLiteral(p, value, ctrl.shouldHuffman())
 }
 
-// Encoder Instructions
-// https://www.rfc-editor.org/rfc/rfc9204.html#name-encoder-instructions
-func (dt *DT) appendEncoderInstructions(p []byte, header map[string][]string) ([]byte, *Encoder) {
+// newEncoderLocked returns a field Encoder referencing the dynamic table
+// entries outside of the draining region.
+func (dt *DT) newEncoderLocked() *Encoder {
+	insertCount := dt.insertCountLocked()
+	drain := dt.drainLocked()
+
+	// Most recently inserted values first.
+	nv := make(nameValues, len(dt.headers))
+	for abs := insertCount; abs > drain; {
+		abs--
+		i := abs - dt.evicted
+		hf := dt.headers[i]
+		nv[hf.name] = append(nv[hf.name], value{value: hf.value, index: abs, refs: dt.refs[i]})
+	}
+	fe := newEncoder(nv, insertCount, dt.knownReceivedCount, dt.maxCapacity, dt.policy)
+	fe.churned = dt.churned
+	return fe
+}
+
+// encoderLocked returns the field Encoder for the current state of the
+// dynamic table, only creating another once the state has changed.
+func (dt *DT) encoderLocked() *Encoder {
+	if dt.encoder == nil {
+		dt.encoder = dt.newEncoderLocked()
+	}
+	return dt.encoder
+}
 
+// Encoder returns a field Encoder for the current state of the dynamic table.
+// The same Encoder is returned until the dynamic table, or Known Received
+// Count, changes.
+func (dt *DT) Encoder() *Encoder {
 	dt.mu.Lock()
 	defer dt.mu.Unlock()
+	return dt.encoderLocked()
+}
 
-	base := dt.insertCountLocked()
+// AppendEncoderInstructions appends the encoder instructions to insert the
+// fields of header into the dynamic table, returning a field Encoder that
+// may reference them, the previous Encoder if nothing was inserted.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-encoder-instructions
+func (dt *DT) AppendEncoderInstructions(p []byte, header Header) ([]byte, *Encoder) {
 
-	for name, values := range header {
-		for _, value := range values {
-			p = dt.appendEncoderInstructionLocked(p, name, value)
-		}
-	}
-	// Build a fieldEncoder for when peer acks.
-	nv := make(nameValues, len(dt.headers))
-	for i, hf := range dt.headers {
-		nv[hf.name] = append(nv[hf.name], value{value: hf.value, index: uint64(i)})
-	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
 
-	return p, newEncoder(nv, base, dt.insertCountLocked()-base, dt.capacity)
+	EachField(header, func(f Field) {
+		p = dt.appendEncoderInstructionLocked(p, f)
+	})
+	return p, dt.encoderLocked()
 }
 
-func (dt *DT) DecodeEncoderInstructions(p []byte) error {
+// DecodeEncoderInstructions decodes the instructions received on the peer's
+// encoder stream, applying them to the dynamic table. Instructions may be
+// split across calls, so returns the bytes of a trailing incomplete
+// instruction, to be prefixed to the next call's input.
+func (dt *DT) DecodeEncoderInstructions(p []byte) ([]byte, error) {
 	var decodeBuf [256]byte
 
 	dt.mu.Lock()
 	defer dt.mu.Unlock()
 
 	for len(p) > 0 {
-		switch p[0] >> 5 {
-		case 0b000:
-			// https://www.rfc-editor.org/rfc/rfc9204.html#name-duplicate
-			const M = 0b0001_1111
-
-			i, q, err := varint.Read(p, M)
-			if err != nil {
-				return err
-			}
-			h, ok := dt.headerFromRelativePosLocked(i)
-			if !ok {
-				return errors.New("duplicate: non-existant header")
-			}
-			if ok := dt.insertLocked(h.name, h.value); !ok {
-				return errors.New("duplicate: failed to insert")
+		q, err := dt.decodeEncoderInstructionLocked(p, decodeBuf[:0])
+		if err != nil {
+			if errors.Is(err, errUnexpectedEnd) || errors.Is(err, varint.ErrUnexpectedEnd) {
+				// Incomplete instruction, await more input.
+				return p, nil
 			}
-			p = q
+			return p, err
+		}
+		p = q
+	}
+	return p, nil
+}
 
-		case 0b001:
-			// https://www.rfc-editor.org/rfc/rfc9204.html#name-set-dynamic-table-capacity
-			const M = 0b0001_1111
+// decodeEncoderInstructionLocked decodes and applies the first instruction in
+// p, returning the remainder of p.
+func (dt *DT) decodeEncoderInstructionLocked(p, decodeBuf []byte) ([]byte, error) {
+	switch p[0] >> 5 {
+	case 0b000:
+		// https://www.rfc-editor.org/rfc/rfc9204.html#name-duplicate
+		const M = 0b0001_1111
 
-			capacity, q, err := varint.Read(p, M)
-			if err != nil {
-				return err
-			}
-			if ok := dt.setCapacityLocked(capacity); !ok {
-				return errors.New("failed to set capacity")
-			}
-			p = q
+		i, q, err := varint.Read(p, M)
+		if err != nil {
+			return p, err
+		}
+		h, ok := dt.headerFromRelativePosLocked(i)
+		if !ok {
+			return p, errors.New("duplicate: non-existant header")
+		}
+		uppercase := dt.isUppercaseLocked(i)
+		if ok := dt.insertLocked(h.name, h.value); !ok {
+			return p, errors.New("duplicate: failed to insert")
+		}
+		if uppercase {
+			dt.markUppercaseLocked()
+		}
+		return q, nil
 
-		case 0b010, 0b011:
-			name, q, err := decodeNameInsertWithLiteralName(p, decodeBuf[:0])
-			if err != nil {
-				return err
-			}
-			value, q, err := readStringLiteral(q, decodeBuf[:0])
-			if err != nil {
-				return err
-			}
-			if ok := dt.insertLocked(name, value); !ok {
-				return errors.New("failed to insert header with literal name")
-			}
-			p = q
+	case 0b001:
+		// https://www.rfc-editor.org/rfc/rfc9204.html#name-set-dynamic-table-capacity
+		const M = 0b0001_1111
 
-		default:
-			name, q, err := dt.decodeNameInsertWithNameReference(p)
-			if err != nil {
-				return err
-			}
-			value, q, err := readStringLiteral(q, decodeBuf[:0])
-			if err != nil {
-				return err
-			}
-			if ok := dt.insertLocked(name, value); !ok {
-				return errors.New("failed to insert header with name reference")
-			}
-			p = q
+		capacity, q, err := varint.Read(p, M)
+		if err != nil {
+			return p, err
+		}
+		if ok := dt.setCapacityLocked(capacity); !ok {
+			return p, errors.New("failed to set capacity")
+		}
+		return q, nil
+
+	case 0b010, 0b011:
+		name, uppercase, q, err := decodeNameInsertWithLiteralName(p, decodeBuf[:0])
+		if err != nil {
+			return p, err
+		}
+		value, q, err := readStringLiteral(q, decodeBuf[:0], math.MaxUint64)
+		if err != nil {
+			return p, err
+		}
+		if ok := dt.insertLocked(name, value); !ok {
+			return p, errors.New("failed to insert header with literal name")
 		}
+		if uppercase && dt.strict {
+			dt.markUppercaseLocked()
+		}
+		return q, nil
+
+	default:
+		name, uppercase, q, err := dt.decodeNameInsertWithNameReference(p)
+		if err != nil {
+			return p, err
+		}
+		value, q, err := readStringLiteral(q, decodeBuf[:0], math.MaxUint64)
+		if err != nil {
+			return p, err
+		}
+		if ok := dt.insertLocked(name, value); !ok {
+			return p, errors.New("failed to insert header with name reference")
+		}
+		if uppercase {
+			dt.markUppercaseLocked()
+		}
+		return q, nil
 	}
-	return nil
 }
@@ -2,7 +2,14 @@ package field
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/renthraysk/quack/internal/inst"
 )
 
 // https://datatracker.ietf.org/doc/html/rfc9204#name-dynamic-table-insert-evicti
@@ -12,8 +19,8 @@ func TestRFC9204_B1(t *testing.T) {
 	got := make([]header, 0, 2)
 
 	d := &Decoder{}
-	err := d.Decode(in, func(name, value string) {
-		got = append(got, header{name, value})
+	err := d.Decode(in, math.MaxUint64, func(f Field) {
+		got = append(got, header{f.Name, f.Value})
 	})
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
@@ -23,6 +30,69 @@ func TestRFC9204_B1(t *testing.T) {
 	}
 }
 
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-2
+func TestRFC9204_B2toB5(t *testing.T) {
+
+	dt := DT{maxCapacity: 220}
+
+	decode := func(in []byte) ([]header, error) {
+		var got []header
+		err := dt.Decoder().Decode(in, math.MaxUint64, func(f Field) {
+			got = append(got, header{f.Name, f.Value})
+		})
+		return got, err
+	}
+
+	if _, err := decode(dehex(t, "03811011")); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected blocked error, got %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		encoderStream string
+		fieldSection  string
+		expected      []header
+	}{
+		// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-2
+		{"B.2", "3fbd01c00f7777772e6578616d706c652e636f6dc10c2f73616d706c652f70617468", "03811011",
+			[]header{{":authority", "www.example.com"}, {":path", "/sample/path"}}},
+		// https://www.rfc-editor.org/rfc/rfc9204.html#name-speculative-insert
+		{"B.3", "4a637573746f6d2d6b65790c637573746f6d2d76616c7565", "", nil},
+		// https://www.rfc-editor.org/rfc/rfc9204.html#name-duplicate-instruction-strea
+		{"B.4", "02", "050080c181",
+			[]header{{":authority", "www.example.com"}, {":path", "/"}, {"Custom-Key", "custom-value"}}},
+		// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-insert-evicti
+		// Field section referencing the newly inserted entry, and the oldest
+		// surviving entry.
+		{"B.5", "810d637573746f6d2d76616c756532", "06008083",
+			[]header{{"Custom-Key", "custom-value2"}, {":path", "/sample/path"}}},
+	}
+	for _, tt := range tests {
+		if _, err := dt.DecodeEncoderInstructions(dehex(t, tt.encoderStream)); err != nil {
+			t.Fatalf("%s: unexpected encoder stream error %v", tt.name, err)
+		}
+		if tt.fieldSection == "" {
+			continue
+		}
+		got, err := decode(dehex(t, tt.fieldSection))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+		if !Equal(got, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+
+	// Relative index 4 refers to the evicted absolute index 0.
+	if _, err := decode(dehex(t, "060084")); !errors.Is(err, errDynamicIndexEvicted) {
+		t.Errorf("expected evicted error, got %v", err)
+	}
+	// Post-base index 0 is beyond the Required Insert Count.
+	if _, err := decode(dehex(t, "060010")); !errors.Is(err, errDynamicIndexOutOfRange) {
+		t.Errorf("expected out of range error, got %v", err)
+	}
+}
+
 func TestRFC9204_DecodingEncoderInstructions(t *testing.T) {
 
 	dt := DT{maxCapacity: 1 << 10}
@@ -30,7 +100,7 @@ func TestRFC9204_DecodingEncoderInstructions(t *testing.T) {
 	// https://datatracker.ietf.org/doc/html/rfc9204#name-dynamic-table-2
 	{
 		in := dehex(t, "3fbd01c00f7777772e6578616d706c652e636f6dc10c2f73616d706c652f70617468")
-		err := dt.DecodeEncoderInstructions(in)
+		_, err := dt.DecodeEncoderInstructions(in)
 		if err != nil {
 			t.Errorf("unexpected error %v", err)
 		}
@@ -50,7 +120,7 @@ func TestRFC9204_DecodingEncoderInstructions(t *testing.T) {
 	// https://datatracker.ietf.org/doc/html/rfc9204#name-speculative-insert
 	{
 		in := dehex(t, "4a637573746f6d2d6b65790c637573746f6d2d76616c7565")
-		err := dt.DecodeEncoderInstructions(in)
+		_, err := dt.DecodeEncoderInstructions(in)
 		if err != nil {
 			t.Errorf("unexpected error %v", err)
 		}
@@ -69,7 +139,7 @@ func TestRFC9204_DecodingEncoderInstructions(t *testing.T) {
 	// https://datatracker.ietf.org/doc/html/rfc9204#name-duplicate-instruction-strea
 	{
 		in := dehex(t, "02")
-		err := dt.DecodeEncoderInstructions(in)
+		_, err := dt.DecodeEncoderInstructions(in)
 		if err != nil {
 			t.Errorf("unexpected error %v", err)
 		}
@@ -89,7 +159,7 @@ func TestRFC9204_DecodingEncoderInstructions(t *testing.T) {
 	// https://datatracker.ietf.org/doc/html/rfc9204#appendix-B.5
 	{
 		in := dehex(t, "810d637573746f6d2d76616c756532")
-		err := dt.DecodeEncoderInstructions(in)
+		_, err := dt.DecodeEncoderInstructions(in)
 		if err != nil {
 			t.Errorf("unexpected error %v", err)
 		}
@@ -108,6 +178,127 @@ func TestRFC9204_DecodingEncoderInstructions(t *testing.T) {
 	}
 }
 
+func TestEvictionSafety(t *testing.T) {
+
+	dt := DT{maxCapacity: 110}
+	dt.mu.Lock()
+	dt.setCapacityLocked(110)
+	dt.mu.Unlock()
+
+	insert := func(value string) bool {
+		p, _ := dt.AppendEncoderInstructions(nil, Map{"X-Key": {value}})
+		return len(p) > 0
+	}
+
+	// Each entry is 5 + 3 + 32 = 40 bytes, so a third insert requires
+	// evicting the first, though the 30 bytes of room keep it outside the
+	// draining region.
+	if !insert("one") || !insert("two") {
+		t.Fatal("expected inserts to succeed")
+	}
+	if insert("thr") {
+		t.Fatal("expected insert evicting unacknowledged entry to fail")
+	}
+	dt.Acknowledge(1)
+	fe := dt.Encoder()
+	s := &Section{Limit: fe.InsertCount()}
+	fe.appendFieldLine(nil, s, Field{Name: "X-Key", Value: "one"})
+	if s.RequiredInsertCount != 1 {
+		t.Fatalf("expected field line to reference entry, got required insert count %d", s.RequiredInsertCount)
+	}
+	if !s.Reference() {
+		t.Fatal("expected reference to succeed")
+	}
+	if insert("thr") {
+		t.Fatal("expected insert evicting referenced entry to fail")
+	}
+	s.Release()
+	if !insert("thr") {
+		t.Fatal("expected insert evicting acknowledged entry to succeed")
+	}
+	if dt.evicted != 1 {
+		t.Errorf("expected 1 eviction, got %d", dt.evicted)
+	}
+	if s.Reference() {
+		t.Error("expected reference to evicted entry to fail")
+	}
+}
+
+func TestDuplicateDraining(t *testing.T) {
+
+	dt := DT{maxCapacity: 160}
+	dt.mu.Lock()
+	dt.setCapacityLocked(160)
+	dt.mu.Unlock()
+
+	var p []byte
+	var fe *Encoder
+	for _, v := range []string{"one", "two", "thr", "fou"} {
+		p, fe = dt.AppendEncoderInstructions(p, Map{"X-Key": {v}})
+	}
+	// Table is full, each entry 40 bytes, so the oldest entry is draining.
+	if _, _, m := fe.lookup("X-Key", "one", fe.InsertCount()); m == matchNameValue {
+		t.Error("expected draining entry to be excluded from field encoder")
+	}
+	if _, _, m := fe.lookup("X-Key", "two", fe.InsertCount()); m != matchNameValue {
+		t.Error("expected entry outside draining region in field encoder")
+	}
+
+	dt.Acknowledge(4)
+	q, fe := dt.AppendEncoderInstructions(nil, Map{"X-Key": {"one"}})
+	if exp := []byte{0x03}; !Equal(q, exp) {
+		t.Fatalf("expected duplicate instruction %x, got %x", exp, q)
+	}
+	if _, _, m := fe.lookup("X-Key", "one", fe.InsertCount()); m != matchNameValue {
+		t.Error("expected duplicated entry in field encoder")
+	}
+
+	// Peer decoder arrives at the same table.
+	peer := DT{maxCapacity: 160}
+	in := inst.AppendSetDynamicTableCapacity(nil, 160)
+	in = append(append(in, p...), q...)
+	if _, err := peer.DecodeEncoderInstructions(in); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !Equal(peer.headers, dt.headers) {
+		t.Errorf("expected %v, got %v", dt.headers, peer.headers)
+	}
+}
+
+func TestDecodeEncoderInstructionsFragmented(t *testing.T) {
+
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-dynamic-table-2
+	in := dehex(t, "3fbd01c00f7777772e6578616d706c652e636f6dc10c2f73616d706c652f70617468")
+
+	for i := range len(in) {
+		dt := DT{maxCapacity: 220}
+
+		rest, err := dt.DecodeEncoderInstructions(in[:i])
+		if err != nil {
+			t.Fatalf("split at %d: unexpected error %v", i, err)
+		}
+		rest, err = dt.DecodeEncoderInstructions(append(rest, in[i:]...))
+		if err != nil {
+			t.Fatalf("split at %d: unexpected error %v", i, err)
+		}
+		if len(rest) != 0 {
+			t.Errorf("split at %d: expected no remaining bytes, got %d", i, len(rest))
+		}
+		exp := []header{
+			{":authority", "www.example.com"},
+			{":path", "/sample/path"}}
+		if !Equal(dt.headers, exp) {
+			t.Errorf("split at %d: expected %v, got %v", i, exp, dt.headers)
+		}
+	}
+
+	// Duplicate of a non-existent entry is malformed, however split.
+	dt := DT{maxCapacity: 220}
+	if _, err := dt.DecodeEncoderInstructions([]byte{0x00}); err == nil {
+		t.Error("expected error")
+	}
+}
+
 func TestSnapshot(t *testing.T) {
 
 	in := DT{}
@@ -154,3 +345,185 @@ func dehex(tb testing.TB, s string) []byte {
 	}
 	return b
 }
+
+func TestNeverIndexInsert(t *testing.T) {
+	var dt DT
+	dt.SetMaxCapacity(4096)
+	dt.AppendSetCapacity(nil, 4096)
+
+	header := List{
+		{Name: "X-Token", Value: "secret", NeverIndex: true},
+		{Name: "X-Public", Value: "value"},
+	}
+	_, fe := dt.AppendEncoderInstructions(nil, header)
+	for _, v := range fe.nv["X-Token"] {
+		if v.value != "" {
+			t.Errorf("expected only the name of a never indexed field inserted, got value %q", v.value)
+		}
+	}
+	if len(fe.nv["X-Public"]) != 1 {
+		t.Errorf("expected X-Public inserted")
+	}
+
+	// Even with an exact match, a never indexed field is encoded as a never
+	// indexed literal.
+	_, fe = dt.AppendEncoderInstructions(nil, List{{Name: "X-Public", Value: "value"}})
+	s := &Section{Limit: fe.InsertCount()}
+	p := fe.appendFieldLine(nil, s, Field{Name: "X-Public", Value: "value", NeverIndex: true})
+	var got Field
+	err := dt.Decoder().Decode(fe.setFieldSectionPrefix(append([]byte{0, 0}, p...), 0, s), math.MaxUint64, func(f Field) {
+		got = f
+	})
+	if err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if exp := (Field{Name: "X-Public", Value: "value", NeverIndex: true}); got != exp {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+}
+
+func TestInsertLimits(t *testing.T) {
+	newDT := func(limits InsertLimits) *DT {
+		dt := new(DT)
+		dt.SetMaxCapacity(4096)
+		dt.AppendSetCapacity(nil, 4096)
+		dt.SetInsertLimits(limits)
+		return dt
+	}
+	insert := func(dt *DT, name, value string) *Encoder {
+		_, fe := dt.AppendEncoderInstructions(nil, List{{Name: name, Value: value}})
+		return fe
+	}
+	values := func(fe *Encoder, name string) []string {
+		var values []string
+		for _, v := range fe.nv[name] {
+			values = append(values, v.value)
+		}
+		return values
+	}
+
+	dt := newDT(InsertLimits{MaxEntries: 2})
+	insert(dt, "X-Key", "value1")
+	insert(dt, "X-Key", "value2")
+	fe := insert(dt, "X-Key", "value3")
+	if got := values(fe, "X-Key"); !slices.Equal(got, []string{"value2", "value1"}) {
+		t.Errorf("expected entries per name limited, got %q", got)
+	}
+
+	dt = newDT(InsertLimits{MinValueLength: 4})
+	fe = insert(dt, "X-Short", "abc")
+	if got := values(fe, "X-Short"); !slices.Equal(got, []string{""}) {
+		t.Errorf("expected only name of short value inserted, got %q", got)
+	}
+
+	// Only inserts of distinct values count, so neither repeats, name only
+	// inserts, nor refused inserts churn a name.
+	dt = newDT(InsertLimits{MinValueLength: 4, MaxInserts: 3})
+	insert(dt, "X-Key", "abc")
+	insert(dt, "X-Key", "value1")
+	insert(dt, "X-Key", "value1")
+	insert(dt, "X-Key", "value2")
+	// Refused, as the table is emptied of capacity.
+	dt.SetMaxCapacity(0)
+	insert(dt, "X-Key", "value3")
+	dt.SetMaxCapacity(4096)
+	dt.AppendSetCapacity(nil, 4096)
+	if fe := dt.Encoder(); fe.isChurned("X-Key") {
+		t.Fatal("expected X-Key not churned")
+	}
+
+	// The third distinct value of X-Key churns it, so even the entry of an
+	// exact match is not referenced.
+	fe = insert(dt, "X-Key", "value3")
+	if !fe.isChurned("X-Key") {
+		t.Fatal("expected X-Key churned")
+	}
+	s := &Section{Limit: fe.InsertCount()}
+	p := fe.AppendTrailers(nil, s, List{{Name: "X-Key", Value: "value3"}})
+	var got Field
+	if err := dt.Decoder().Decode(p, math.MaxUint64, func(f Field) { got = f }); err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if exp := (Field{Name: "X-Key", Value: "value3", NeverIndex: true}); got != exp {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+	if n := len(insert(dt, "X-Key", "value4").nv["X-Key"]); n != 1 {
+		t.Errorf("expected no further X-Key inserts, got %d entries", n)
+	}
+
+	// Names tracked are bounded by the entries the dynamic table can hold.
+	dt = newDT(InsertLimits{MaxInserts: 2})
+	for i := range 4096 / 32 * 2 {
+		insert(dt, fmt.Sprintf("X-%d", i), "value")
+	}
+	if n := len(dt.inserts); n > 4096/32 {
+		t.Errorf("expected at most %d names tracked, got %d", 4096/32, n)
+	}
+}
+
+func TestDrainingRegion(t *testing.T) {
+	tests := []struct {
+		sizes []int
+		drain uint64
+	}{
+		// 30 bytes of room, so inserting 40 requires evicting the oldest.
+		{[]int{40, 40, 50}, 1},
+		// 40 bytes of room, so inserting 40 requires no eviction.
+		{[]int{40, 40, 40}, 0},
+		{[]int{50, 50, 50}, 1},
+		{[]int{60, 60, 40}, 1},
+		{[]int{35, 35, 90}, 2},
+	}
+	for _, tt := range tests {
+		var dt DT
+		dt.SetMaxCapacity(160)
+		dt.AppendSetCapacity(nil, 160)
+		for _, size := range tt.sizes {
+			if !dt.insertLocked("a", strings.Repeat("v", size-33)) {
+				t.Fatalf("failed to insert entry of size %d", size)
+			}
+		}
+		if drain := dt.drainLocked(); drain != tt.drain {
+			t.Errorf("expected draining region of %v to end at %d, got %d", tt.sizes, tt.drain, drain)
+		}
+	}
+}
+
+func TestEncoderUnchanged(t *testing.T) {
+	var dt DT
+	dt.SetMaxCapacity(4096)
+	dt.AppendSetCapacity(nil, 4096)
+
+	header := List{
+		{Name: "X-Custom", Value: "value"},
+		{Name: "X-Token", Value: "secret", NeverIndex: true},
+		{Name: "Accept", Value: "*/*"},
+	}
+	if dt.Encoder().Indexed(header) {
+		t.Fatalf("expected fields not indexed before insert")
+	}
+	if p, _ := dt.AppendEncoderInstructions(nil, header); len(p) == 0 {
+		t.Fatalf("expected inserts")
+	}
+	if !dt.Encoder().Indexed(header) {
+		t.Fatalf("expected fields indexed once inserted")
+	}
+
+	// Nothing inserted, so the same Encoder.
+	fe := dt.Encoder()
+	p, got := dt.AppendEncoderInstructions(nil, header)
+	if len(p) != 0 || got != fe {
+		t.Errorf("expected no instructions and the same Encoder, got %d bytes", len(p))
+	}
+
+	// Known Received Count advanced, so another Encoder.
+	dt.Acknowledge(1)
+	if dt.Encoder() == fe {
+		t.Errorf("expected another Encoder once Known Received Count changed")
+	}
+	fe = dt.Encoder()
+	dt.Acknowledge(1)
+	if dt.Encoder() != fe {
+		t.Errorf("expected the same Encoder for an unchanged Known Received Count")
+	}
+}
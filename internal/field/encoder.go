@@ -1,7 +1,8 @@
 package field
 
 import (
-	"math/bits"
+	"math"
+	"slices"
 	"time"
 
 	"github.com/renthraysk/quack/huffman"
@@ -24,128 +25,306 @@ const (
 type value struct {
 	value string
 	index uint64
+	refs  *refCount
 }
 
 type nameValues map[string][]value
 
 // Encoder field line encoder, immutable once created
 type Encoder struct {
-	nv          nameValues
-	base        uint64
+	// nv the dynamic table entries that may be referenced, most recently
+	// inserted first.
+	nv nameValues
+	// insertCount is the number of dynamic table inserts when created, and
+	// the Base of the field sections encoded.
 	insertCount uint64
-	capacity    uint64
+	// knownReceivedCount is the Known Received Count when created.
+	knownReceivedCount uint64
+	// maxCapacity is the peer's maximum dynamic table capacity.
+	maxCapacity uint64
+	// policy decides which fields are never indexed or Huffman encoded.
+	policy Policy
+	// churned are the names whose fields are encoded as never indexed
+	// literals, shared with the dynamic table so not to be modified.
+	churned map[string]struct{}
 }
 
-func newEncoder(nv nameValues, base, insertCount, capacity uint64) *Encoder {
+func newEncoder(nv nameValues, insertCount, knownReceivedCount, maxCapacity uint64, policy Policy) *Encoder {
 	return &Encoder{
-		nv:          nv,
-		base:        base,
-		insertCount: insertCount,
-		capacity:    capacity,
+		nv:                 nv,
+		insertCount:        insertCount,
+		knownReceivedCount: knownReceivedCount,
+		maxCapacity:        maxCapacity,
+		policy:             policy,
+	}
+}
+
+// isChurned returns true if fields of name have had too many values inserted
+// into the dynamic table to be indexed further.
+func (fe *Encoder) isChurned(name string) bool {
+	if fe == nil {
+		return false
+	}
+	_, ok := fe.churned[name]
+	return ok
+}
+
+// control returns the Control of field f, under DefaultPolicy if fe is nil.
+func (fe *Encoder) control(f Field) Control {
+	var policy Policy
+	if fe != nil {
+		policy = fe.policy
+	}
+	return policy.control(f)
+}
+
+// InsertCount returns the number of dynamic table inserts the encoder may
+// reference.
+func (fe *Encoder) InsertCount() uint64 {
+	if fe == nil {
+		return 0
+	}
+	return fe.insertCount
+}
+
+// KnownReceivedCount returns the number of dynamic table inserts the peer's
+// decoder was known to have received when the encoder was created. Entries
+// below it may be referenced without risk of blocking.
+func (fe *Encoder) KnownReceivedCount() uint64 {
+	if fe == nil {
+		return 0
+	}
+	return fe.knownReceivedCount
+}
+
+// Indexed returns true if every field of header can be encoded referencing
+// the static table, or the dynamic table entries of fe, such that inserting
+// the fields of header into the dynamic table would change nothing. Never
+// indexed fields need only match by name.
+func (fe *Encoder) Indexed(header Header) bool {
+	indexed := true
+	EachField(header, func(f Field) {
+		if !indexed {
+			return
+		}
+		if fe.isChurned(f.Name) {
+			f.NeverIndex = true
+		}
+		switch _, _, m := fe.lookup(f.Name, f.Value, math.MaxUint64); m {
+		case matchNameValue:
+		case matchName:
+			indexed = f.NeverIndex || fe.control(f).neverIndex()
+		default:
+			indexed = false
+		}
+	})
+	return indexed
+}
+
+// Section accumulates the dynamic table references of a field section as it
+// is encoded.
+type Section struct {
+	// Limit is the absolute index from which dynamic table entries may not
+	// be referenced.
+	Limit uint64
+	// RequiredInsertCount of the encoded field section.
+	RequiredInsertCount uint64
+	// refs of the dynamic table entries referenced.
+	refs []*refCount
+}
+
+// reference records a reference to the dynamic table entry v.
+func (s *Section) reference(v value) {
+	s.refs = append(s.refs, v.refs)
+	s.RequiredInsertCount = max(s.RequiredInsertCount, v.index+1)
+}
+
+// Reference acquires the references to the dynamic table entries the field
+// section references, preventing their eviction until Release. Returns false,
+// acquiring none, if any have already been evicted.
+func (s *Section) Reference() bool {
+	for i, rc := range s.refs {
+		if !rc.acquire() {
+			for _, rc := range s.refs[:i] {
+				rc.release()
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Release releases the references acquired by Reference, once the field
+// section has been acknowledged or cancelled.
+func (s *Section) Release() {
+	for _, rc := range s.refs {
+		rc.release()
 	}
 }
 
 // https://www.rfc-editor.org/rfc/rfc9114.html#name-request-pseudo-header-field
-func (fe *Encoder) AppendRequest(p []byte, method, scheme, authority, path string, header map[string][]string) []byte {
-	p = fe.appendFieldSectionPrefix(p)
+func (fe *Encoder) AppendRequest(p []byte, s *Section, method, scheme, authority, path string, header Header) []byte {
+	i := len(p)
+	p = append(p, 0, 0) // Field section prefix, for static table only.
 	// All pseudo-header fields MUST appear in the header section before regular header fields.
 	// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-control-data
 	p = appendMethod(p, method)
 	p = appendScheme(p, scheme)
 	p = appendAuthority(p, authority)
 	p = appendPath(p, path)
-	p = fe.appendFieldLines(p, header)
-	return p
+	p = fe.appendFieldLines(p, s, header)
+	return fe.setFieldSectionPrefix(p, i, s)
 }
 
 // https://www.rfc-editor.org/rfc/rfc9114.html#name-response-pseudo-header-fiel
-func (fe *Encoder) AppendResponse(p []byte, statusCode int, header map[string][]string) []byte {
-	p = fe.appendFieldSectionPrefix(p)
+func (fe *Encoder) AppendResponse(p []byte, s *Section, statusCode int, header Header) []byte {
+	i := len(p)
+	p = append(p, 0, 0) // Field section prefix, for static table only.
 	// All pseudo-header fields MUST appear in the header section before regular header fields.
 	// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-control-data
 	p = appendStatus(p, statusCode)
 
 	if statusCode < 100 || statusCode >= 200 {
 		// Automagic the Date header if absent
-		if _, ok := header["Date"]; !ok {
+		if !header.Has("Date") {
 			p = appendDate(p, time.Now())
 		}
 	}
-	p = fe.appendFieldLines(p, header)
-	return p
+	p = fe.appendFieldLines(p, s, header)
+	return fe.setFieldSectionPrefix(p, i, s)
 }
 
 // https://www.rfc-editor.org/rfc/rfc9114.html#name-the-connect-method
-func (fe *Encoder) AppendConnect(p []byte, authority string, header map[string][]string) []byte {
-	p = fe.appendFieldSectionPrefix(p)
+func (fe *Encoder) AppendConnect(p []byte, s *Section, authority string, header Header) []byte {
+	i := len(p)
+	p = append(p, 0, 0) // Field section prefix, for static table only.
 	// All pseudo-header fields MUST appear in the header section before regular header fields.
 	// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-control-data
 	p = appendMethod(p, "CONNECT")
 	p = appendAuthority(p, authority)
-	p = fe.appendFieldLines(p, header)
-	return p
+	p = fe.appendFieldLines(p, s, header)
+	return fe.setFieldSectionPrefix(p, i, s)
 }
 
-// https://www.rfc-editor.org/rfc/rfc9204.html#name-encoded-field-section-prefi
-func (fe *Encoder) appendFieldSectionPrefix(p []byte) []byte {
-	if fe == nil {
-		// Operating with only static table
-		return append(p, 0, 0)
+// https://www.rfc-editor.org/rfc/rfc9220.html#name-websockets-upgrade-over-htt
+func (fe *Encoder) AppendExtendedConnect(p []byte, s *Section, protocol, scheme, authority, path string, header Header) []byte {
+	i := len(p)
+	p = append(p, 0, 0) // Field section prefix, for static table only.
+	// All pseudo-header fields MUST appear in the header section before regular header fields.
+	// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-control-data
+	p = appendMethod(p, "CONNECT")
+	p = appendProtocol(p, protocol)
+	p = appendScheme(p, scheme)
+	p = appendAuthority(p, authority)
+	p = appendPath(p, path)
+	p = fe.appendFieldLines(p, s, header)
+	return fe.setFieldSectionPrefix(p, i, s)
+}
+
+// AppendTrailers appends a trailer section, which has no pseudo-header
+// fields.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-message-framing
+func (fe *Encoder) AppendTrailers(p []byte, s *Section, header Header) []byte {
+	i := len(p)
+	p = append(p, 0, 0) // Field section prefix, for static table only.
+	p = fe.appendFieldLines(p, s, header)
+	return fe.setFieldSectionPrefix(p, i, s)
+}
+
+// setFieldSectionPrefix sets the field section prefix at p[i:], where two
+// bytes were reserved for it, once the Required Insert Count is known.
+func (fe *Encoder) setFieldSectionPrefix(p []byte, i int, s *Section) []byte {
+	if s == nil || s.RequiredInsertCount == 0 {
+		// Static table only prefix is already in place.
+		return p
 	}
+	var buf [2 * 10]byte
+
+	prefix := fe.appendFieldSectionPrefix(buf[:0], s.RequiredInsertCount)
+	copy(p[i:i+2], prefix)
+	return slices.Insert(p, i+2, prefix[2:]...)
+}
 
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-encoded-field-section-prefi
+func (fe *Encoder) appendFieldSectionPrefix(p []byte, reqInsertCount uint64) []byte {
 	// https://www.rfc-editor.org/rfc/rfc9204.html#name-required-insert-count
-	maxEntries := fe.capacity / 32
-	p = varint.Append(p, 0, 0xFF, (fe.insertCount%(2*maxEntries))+1)
+	maxEntries := fe.maxCapacity / 32
+	p = varint.Append(p, 0, 0xFF, (reqInsertCount%(2*maxEntries))+1)
 
 	// https://www.rfc-editor.org/rfc/rfc9204.html#name-base
-	deltaBase, sign := bits.Sub64(fe.base, fe.insertCount, 0)
-	if sign != 0 {
-		deltaBase = fe.insertCount - fe.base - 1
-		sign = 0x80
-	}
-	return varint.Append(p, byte(sign), 0x7F, deltaBase)
+	// Base is the insert count, so all references are relative, and the
+	// Required Insert Count can never exceed it.
+	return varint.Append(p, 0, 0x7F, fe.insertCount-reqInsertCount)
 }
 
-func (fe *Encoder) lookup(name, value string) (index uint64, isStatic bool, m match) {
-	index, m = staticLookup(name, value)
+// lookup searches the static table, and the dynamic table entries below
+// limit for the best match of name & value. For static matches only the
+// index of the returned value is set.
+func (fe *Encoder) lookup(name, val string, limit uint64) (v value, isStatic bool, m match) {
+	v.index, m = staticLookup(name, val)
 	if fe == nil || m == matchNameValue {
 		// Operating with only static table or have the best match already.
-		return index, true, m
+		return v, true, m
 	}
-	values, ok := fe.nv[name]
-	if ok {
-		for _, v := range values {
-			if v.value == value {
-				return v.index, false, matchNameValue
-			}
+	var nameMatch value
+	var nameOk bool
+	for _, dv := range fe.nv[name] {
+		if dv.index >= limit {
+			continue
+		}
+		if dv.value == val {
+			return dv, false, matchNameValue
+		}
+		if !nameOk {
+			nameMatch, nameOk = dv, true
 		}
 	}
 	switch {
 	case m == matchName:
-		return index, true, matchName
-	case ok && len(values) > 0:
-		return values[0].index, false, matchName
+		return v, true, matchName
+	case nameOk:
+		return nameMatch, false, matchName
 	}
-	return 0, false, matchNone
+	return value{}, false, matchNone
 }
 
-func (fe *Encoder) appendFieldLines(p []byte, header map[string][]string) []byte {
-	for name, values := range header {
-		for _, value := range values {
-			p = fe.appendFieldLine(p, name, value)
-		}
-	}
+func (fe *Encoder) appendFieldLines(p []byte, s *Section, header Header) []byte {
+	EachField(header, func(f Field) {
+		p = fe.appendFieldLine(p, s, f)
+	})
 	return p
 }
 
-func (fe *Encoder) appendFieldLine(p []byte, name, value string) []byte {
-	ctrl := headerControl(name)
-	switch i, isStatic, m := fe.lookup(name, value); m {
+// appendFieldLine appends the field line of f to p. Fields marked NeverIndex,
+// or of churned names, are always encoded as never indexed literals, as
+// intermediaries must preserve.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-literal-field-line-with-nam
+func (fe *Encoder) appendFieldLine(p []byte, s *Section, f Field) []byte {
+	var limit uint64
+	if s != nil {
+		limit = s.Limit
+	}
+	if fe.isChurned(f.Name) {
+		f.NeverIndex = true
+	}
+	name, value := f.Name, f.Value
+	ctrl := fe.control(f)
+	v, isStatic, m := fe.lookup(name, value, limit)
+	if f.NeverIndex {
+		m = min(m, matchName)
+	}
+	i := v.index
+	if !isStatic && m != matchNone {
+		s.reference(v)
+		// https://www.rfc-editor.org/rfc/rfc9204.html#name-relative-indexing
+		i = fe.insertCount - i - 1
+	}
+	switch m {
 	case matchNameValue:
 		if isStatic {
 			return inst.AppendStaticIndexReference(p, i)
 		}
-		return inst.AppendIndexedLinePostBase(p, i)
+		return inst.AppendDynamicIndexReference(p, i)
 
 	case matchName:
 		p = inst.AppendNamedReference(p, i, ctrl.neverIndex(), isStatic)
@@ -259,6 +438,14 @@ func appendMethod(p []byte, method string) []byte {
 	return inst.AppendStringLiteral(p, method, true)
 }
 
+// appendProtocol appends a :protocol pseudo header field to p, which is absent
+// from the static table.
+// https://www.rfc-editor.org/rfc/rfc8441.html#section-4
+func appendProtocol(p []byte, protocol string) []byte {
+	p = inst.AppendLiteralName(p, ":protocol", false)
+	return inst.AppendStringLiteral(p, protocol, true)
+}
+
 // appendScheme appends a :scheme pseudo header field to p
 func appendScheme(p []byte, scheme string) []byte {
 	switch scheme {
@@ -1,5 +1,7 @@
 package field
 
+import "slices"
+
 type header struct {
 	name  string
 	value string
@@ -13,3 +15,88 @@ func (h header) size() uint64 {
 func headerSize(name, value string) uint64 {
 	return uint64(len(name)) + uint64(len(value)) + 32
 }
+
+// Header is the regular fields of a field section.
+type Header interface {
+	// Fields calls f for each field, in the order they are to be encoded.
+	Fields(f func(Field))
+	// Has reports whether a field name is present.
+	Has(name string) bool
+}
+
+// Map is a Header of a map of names to values, as http.Header, encoded in
+// no particular order.
+type Map map[string][]string
+
+func (m Map) Fields(f func(Field)) {
+	for name, values := range m {
+		for _, value := range values {
+			f(Field{Name: name, Value: value})
+		}
+	}
+}
+
+func (m Map) Has(name string) bool {
+	_, ok := m[name]
+	return ok
+}
+
+// SortedMap is a Header of a map of names to values, encoded in name order,
+// so identical maps have identical encodings.
+type SortedMap struct {
+	m map[string][]string
+	// names of m, sorted once as Fields is called repeatedly per encode.
+	names []string
+}
+
+// NewSortedMap returns the SortedMap of m, which should not be modified while
+// the SortedMap is in use.
+func NewSortedMap(m map[string][]string) SortedMap {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return SortedMap{m: m, names: names}
+}
+
+func (m SortedMap) Fields(f func(Field)) {
+	for _, name := range m.names {
+		for _, value := range m.m[name] {
+			f(Field{Name: name, Value: value})
+		}
+	}
+}
+
+func (m SortedMap) Has(name string) bool {
+	_, ok := m.m[name]
+	return ok
+}
+
+// Field is a name value pair.
+type Field struct {
+	Name  string
+	Value string
+	// NeverIndex is set if the field line was, or is to be, encoded as a
+	// literal that intermediaries must not index.
+	// https://www.rfc-editor.org/rfc/rfc9204.html#name-never-indexed-literals
+	NeverIndex bool
+}
+
+// List is a Header of fields, encoded in order.
+type List []Field
+
+func (l List) Fields(f func(Field)) {
+	for _, fl := range l {
+		f(fl)
+	}
+}
+
+func (l List) Has(name string) bool {
+	for _, fl := range l {
+		if fl.Name == name {
+			return true
+		}
+	}
+	return false
+}
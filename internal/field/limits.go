@@ -0,0 +1,96 @@
+package field
+
+import "maps"
+
+// InsertLimits restrict the dynamic table inserts of an encoder, mitigating
+// attacks that probe the dynamic table state, guessing field values from the
+// size of the compressed output.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-mitigation
+type InsertLimits struct {
+	// MaxEntries is the number of entries of the same name the dynamic
+	// table may hold, 0 if unlimited.
+	MaxEntries uint64
+	// MinValueLength is the length below which values, being easier to
+	// guess, are not inserted. Only the name is.
+	MinValueLength uint64
+	// MaxInserts is the number of distinct values of the same name, each a
+	// potentially failed guess, to insert before fields of that name are
+	// encoded as never indexed literals. 0 if unlimited.
+	MaxInserts uint64
+}
+
+// SetInsertLimits sets the InsertLimits of the dynamic table.
+func (dt *DT) SetInsertLimits(limits InsertLimits) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.limits = limits
+}
+
+// isChurnedLocked returns true if fields of name have had too many values
+// inserted to be indexed further.
+func (dt *DT) isChurnedLocked(name string) bool {
+	_, ok := dt.churned[name]
+	return ok
+}
+
+// insertedLocked records the successful insert of value for name, churning
+// name once MaxInserts distinct values have been inserted. Churned names are
+// copied on write, as Encoders share them.
+func (dt *DT) insertedLocked(name, value string) {
+	if dt.limits.MaxInserts == 0 {
+		return
+	}
+	values, ok := dt.inserts[name]
+	if !ok {
+		dt.pruneInsertsLocked()
+		values = make(map[string]struct{})
+		dt.inserts[name] = values
+	}
+	values[value] = struct{}{}
+	if uint64(len(values)) < dt.limits.MaxInserts {
+		return
+	}
+	churned := maps.Clone(dt.churned)
+	if churned == nil {
+		churned = make(map[string]struct{})
+	}
+	churned[name] = struct{}{}
+	dt.churned = churned
+	dt.encoder = nil
+	delete(dt.inserts, name)
+}
+
+// pruneInsertsLocked makes room to track the values inserted of another name.
+// The names tracked are bounded by the entries the dynamic table can hold,
+// by forgetting names no longer in the dynamic table once the bound is
+// reached.
+func (dt *DT) pruneInsertsLocked() {
+	if dt.inserts == nil {
+		dt.inserts = make(map[string]map[string]struct{})
+	}
+	if uint64(len(dt.inserts)) < dt.maxCapacity/32 {
+		return
+	}
+	for name := range dt.inserts {
+		if dt.entriesLocked(name) == 0 {
+			delete(dt.inserts, name)
+		}
+	}
+}
+
+// entriesLocked returns the number of entries of name in the dynamic table.
+func (dt *DT) entriesLocked(name string) uint64 {
+	var n uint64
+	for _, hf := range dt.headers {
+		if hf.name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// permitInsertLocked returns true if the limits permit the insert of another
+// entry of name.
+func (dt *DT) permitInsertLocked(name string) bool {
+	return dt.limits.MaxEntries == 0 || dt.entriesLocked(name) < dt.limits.MaxEntries
+}
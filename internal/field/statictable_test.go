@@ -1,6 +1,7 @@
 package field
 
 import (
+	"math"
 	"strconv"
 	"strings"
 	"testing"
@@ -95,15 +96,15 @@ func TestFieldEncoderStaticTable(t *testing.T) {
 						t.Fatalf("unknown pseudo header %s", name)
 					}
 				} else {
-					p = e.appendFieldLine(buf, name, value)
+					p = e.appendFieldLine(buf, nil, Field{Name: name, Value: value})
 				}
 				d := &Decoder{}
-				err := d.Decode(p, func(k, v string) {
-					if name != k {
-						t.Errorf("expected name %q, got %q", name, k)
+				err := d.Decode(p, math.MaxUint64, func(f Field) {
+					if name != f.Name {
+						t.Errorf("expected name %q, got %q", name, f.Name)
 					}
-					if value != v {
-						t.Errorf("expected value %q, got %q", value, v)
+					if value != f.Value {
+						t.Errorf("expected value %q, got %q", value, f.Value)
 					}
 				})
 				if err != nil {
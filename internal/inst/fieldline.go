@@ -19,6 +19,15 @@ func AppendStaticIndexReference(p []byte, i uint64) []byte {
 	return varint.Append(p, P|T, M, i)
 }
 
+// AppendDynamicIndexReference https://www.rfc-editor.org/rfc/rfc9204.html#name-indexed-field-line
+func AppendDynamicIndexReference(p []byte, i uint64) []byte {
+	const (
+		P = 0b1000_0000 // Prefix
+		M = 0b0011_1111 // Mask
+	)
+	return varint.Append(p, P, M, i)
+}
+
 // AppendIndexedLinePostBase https://www.rfc-editor.org/rfc/rfc9204.html#name-indexed-field-line-with-pos
 func AppendIndexedLinePostBase(p []byte, i uint64) []byte {
 	const P = 0b0001_0000 // Prefix
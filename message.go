@@ -0,0 +1,245 @@
+package quack
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/renthraysk/quack/ascii"
+)
+
+// Request is the control data of a request, from its pseudo-header fields.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-request-pseudo-header-field
+type Request struct {
+	Method string
+	// Protocol is the :protocol of an extended CONNECT request.
+	Protocol  string
+	Scheme    string
+	Authority string
+	Path      string
+}
+
+// Response is the control data of a response, from its pseudo-header fields.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-response-pseudo-header-fiel
+type Response struct {
+	StatusCode int
+}
+
+var (
+	errPseudoAfterRegular = errors.New("pseudo-header field after regular field")
+	errPseudoInTrailers   = errors.New("pseudo-header field in trailers")
+)
+
+// isConnectionSpecific reports whether a field is connection-specific, and
+// so prohibited in HTTP/3.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-connection-specific-header-
+func isConnectionSpecific(name, value string) bool {
+	switch name {
+	case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+		return true
+	case "Te":
+		// The only exception to this is the TE header field, which MAY be
+		// present in an HTTP/3 request header; when it is, it MUST NOT
+		// contain any value other than "trailers".
+		return value != "trailers"
+	}
+	return false
+}
+
+// checkField returns an error if the field is malformed, or is
+// connection-specific.
+func checkField(name, value string) error {
+	if !ascii.IsNameValid(name) {
+		return fmt.Errorf("invalid field name %q", name)
+	}
+	if !ascii.IsValueValid(value) {
+		return fmt.Errorf("invalid value for field %s", name)
+	}
+	if isConnectionSpecific(name, value) {
+		return fmt.Errorf("connection-specific field %s", name)
+	}
+	return nil
+}
+
+// pseudo identifies a pseudo-header field, as a bit set of those seen.
+type pseudo uint8
+
+const (
+	pseudoMethod pseudo = 1 << iota
+	pseudoProtocol
+	pseudoScheme
+	pseudoAuthority
+	pseudoPath
+	pseudoStatus
+)
+
+// message validates the pseudo-header fields of a field section as it is
+// decoded, passing the regular fields on to accept.
+type message struct {
+	accept func(name, value string)
+	// pseudo sets the value of a pseudo-header field, returning false if
+	// not permitted in the message. Nil for trailers.
+	pseudo  func(name, value string) (pseudo, bool)
+	seen    pseudo
+	regular bool
+	err     error
+}
+
+func (m *message) field(name, value string) {
+	if m.err != nil {
+		return
+	}
+	if len(name) == 0 || name[0] != ':' {
+		m.regular = true
+		m.accept(name, value)
+		return
+	}
+	// All pseudo-header fields MUST appear in the header section before
+	// regular header fields.
+	// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-control-data
+	if m.regular {
+		m.err = ErrMessage{errPseudoAfterRegular}
+		return
+	}
+	if m.pseudo == nil {
+		m.err = ErrMessage{errPseudoInTrailers}
+		return
+	}
+	p, ok := m.pseudo(name, value)
+	if !ok {
+		m.err = ErrMessage{fmt.Errorf("unexpected pseudo-header field %s", name)}
+		return
+	}
+	if m.seen&p != 0 {
+		m.err = ErrMessage{fmt.Errorf("duplicate pseudo-header field %s", name)}
+		return
+	}
+	m.seen |= p
+}
+
+// decode decodes the field section in with d, validating it with m, and
+// check once decoded.
+func (m *message) decode(d *Decoder, streamID uint64, in []byte, check func() error, done func(error)) error {
+	finish := func(err error) error {
+		if err != nil {
+			return err
+		}
+		if m.err != nil {
+			return m.err
+		}
+		return check()
+	}
+	var unblocked func(error)
+	if done != nil {
+		unblocked = func(err error) { done(finish(err)) }
+	}
+	err := d.Decode(streamID, in, m.field, unblocked)
+	if err == ErrBlocked {
+		return err
+	}
+	return finish(err)
+}
+
+// DecodeRequest decodes a request header section as Decode, setting the
+// control data of req from the pseudo-header fields, and passing the regular
+// fields to accept. Returns an ErrMessage if the pseudo-header fields are
+// malformed.
+func (d *Decoder) DecodeRequest(streamID uint64, in []byte, req *Request, accept func(name, value string), done func(error)) error {
+	m := &message{accept: accept}
+	m.pseudo = func(name, value string) (pseudo, bool) {
+		switch name {
+		case ":method":
+			req.Method = value
+			return pseudoMethod, true
+		case ":protocol":
+			req.Protocol = value
+			return pseudoProtocol, true
+		case ":scheme":
+			req.Scheme = value
+			return pseudoScheme, true
+		case ":authority":
+			req.Authority = value
+			return pseudoAuthority, true
+		case ":path":
+			req.Path = value
+			return pseudoPath, true
+		}
+		return 0, false
+	}
+	return m.decode(d, streamID, in, func() error { return checkRequest(m.seen, req) }, done)
+}
+
+// checkRequest checks the pseudo-header fields of a request are present as
+// its method requires.
+func checkRequest(seen pseudo, req *Request) error {
+	if seen&pseudoMethod == 0 || req.Method == "" {
+		return ErrMessage{errors.New("missing :method")}
+	}
+	if req.Method == "CONNECT" && seen&pseudoProtocol == 0 {
+		// The :scheme and :path pseudo-header fields are omitted, and the
+		// :authority pseudo-header field contains the host and port.
+		// https://www.rfc-editor.org/rfc/rfc9114.html#name-the-connect-method
+		if seen&(pseudoScheme|pseudoPath) != 0 {
+			return ErrMessage{errors.New(":scheme or :path in CONNECT request")}
+		}
+		if req.Authority == "" {
+			return ErrMessage{errors.New("missing :authority in CONNECT request")}
+		}
+		return nil
+	}
+	if seen&pseudoProtocol != 0 {
+		if req.Method != "CONNECT" {
+			return ErrMessage{errors.New(":protocol in non CONNECT request")}
+		}
+		// Extended CONNECT requests include :scheme, :path and :authority.
+		// https://www.rfc-editor.org/rfc/rfc9220.html#name-websockets-upgrade-over-htt
+		if seen&pseudoAuthority == 0 || req.Authority == "" {
+			return ErrMessage{errors.New("missing :authority in extended CONNECT request")}
+		}
+	}
+	// All HTTP/3 requests MUST include exactly one value for the :method,
+	// :scheme, and :path pseudo-header fields, unless the request is a
+	// CONNECT request.
+	if seen&pseudoScheme == 0 || req.Scheme == "" {
+		return ErrMessage{errors.New("missing :scheme")}
+	}
+	if seen&pseudoPath == 0 || req.Path == "" {
+		return ErrMessage{errors.New("missing :path")}
+	}
+	return nil
+}
+
+// DecodeResponse decodes a response header section as Decode, setting the
+// control data of resp from the pseudo-header fields, and passing the
+// regular fields to accept. Returns an ErrMessage if the pseudo-header fields
+// are malformed.
+func (d *Decoder) DecodeResponse(streamID uint64, in []byte, resp *Response, accept func(name, value string), done func(error)) error {
+	m := &message{accept: accept}
+	var status string
+	m.pseudo = func(name, value string) (pseudo, bool) {
+		if name == ":status" {
+			status = value
+			return pseudoStatus, true
+		}
+		return 0, false
+	}
+	return m.decode(d, streamID, in, func() error {
+		if m.seen&pseudoStatus == 0 {
+			return ErrMessage{errors.New("missing :status")}
+		}
+		statusCode, err := strconv.Atoi(status)
+		if err != nil || len(status) != 3 || statusCode < 100 {
+			return ErrMessage{fmt.Errorf("invalid :status %q", status)}
+		}
+		resp.StatusCode = statusCode
+		return nil
+	}, done)
+}
+
+// DecodeTrailers decodes a trailer section as Decode, returning an
+// ErrMessage if it contains pseudo-header fields.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-http-control-data
+func (d *Decoder) DecodeTrailers(streamID uint64, in []byte, accept func(name, value string), done func(error)) error {
+	m := &message{accept: accept}
+	return m.decode(d, streamID, in, func() error { return nil }, done)
+}
@@ -0,0 +1,255 @@
+package quack
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/renthraysk/quack/internal/inst"
+)
+
+// appendLiteral appends a field line with a literal name & value.
+func appendLiteral(p []byte, name, value string) []byte {
+	p = inst.AppendLiteralName(p, name, false)
+	return inst.AppendStringLiteral(p, value, false)
+}
+
+// Static table indices of pseudo-header fields.
+const (
+	staticAuthority = 0
+	staticPath      = 1
+	staticMethodGET = 17
+	staticSchemeTLS = 23
+	staticStatus200 = 25
+)
+
+func TestDecodeRequest(t *testing.T) {
+	d := NewDecoder()
+
+	static := func(p []byte, i ...uint64) []byte {
+		for _, i := range i {
+			p = inst.AppendStaticIndexReference(p, i)
+		}
+		return p
+	}
+	authority := func(p []byte, authority string) []byte {
+		p = inst.AppendNamedReference(p, staticAuthority, false, true)
+		return inst.AppendStringLiteral(p, authority, false)
+	}
+	prefix := []byte{0, 0}
+
+	tests := []struct {
+		name     string
+		in       []byte
+		expected Request
+		valid    bool
+	}{
+		{"get", authority(static(prefix, staticMethodGET, staticSchemeTLS, staticPath), "example.com"),
+			Request{Method: "GET", Scheme: "https", Authority: "example.com", Path: "/"}, true},
+		{"connect", authority(appendLiteral(prefix, ":method", "CONNECT"), "example.com:443"),
+			Request{Method: "CONNECT", Authority: "example.com:443"}, true},
+		{"extended connect", authority(static(appendLiteral(appendLiteral(prefix, ":method", "CONNECT"), ":protocol", "websocket"), staticSchemeTLS, staticPath), "example.com"),
+			Request{Method: "CONNECT", Protocol: "websocket", Scheme: "https", Authority: "example.com", Path: "/"}, true},
+
+		{"missing method", static(prefix, staticSchemeTLS, staticPath), Request{}, false},
+		{"missing path", static(prefix, staticMethodGET, staticSchemeTLS), Request{}, false},
+		{"duplicate", static(prefix, staticMethodGET, staticSchemeTLS, staticPath, staticPath), Request{}, false},
+		{"unknown", appendLiteral(static(prefix, staticMethodGET, staticSchemeTLS, staticPath), ":unknown", "x"), Request{}, false},
+		{"response", static(prefix, staticMethodGET, staticSchemeTLS, staticPath, staticStatus200), Request{}, false},
+		{"out of order", static(appendLiteral(static(prefix, staticMethodGET, staticSchemeTLS), "x-a", "1"), staticPath), Request{}, false},
+		{"connect with path", static(appendLiteral(prefix, ":method", "CONNECT"), staticPath), Request{}, false},
+		{"extended connect without authority", static(appendLiteral(appendLiteral(prefix, ":method", "CONNECT"), ":protocol", "websocket"), staticSchemeTLS, staticPath), Request{}, false},
+		{"protocol without connect", appendLiteral(static(prefix, staticMethodGET, staticSchemeTLS, staticPath), ":protocol", "websocket"), Request{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req Request
+			err := d.DecodeRequest(0, tt.in, &req, func(string, string) {}, nil)
+			if !tt.valid {
+				var me ErrMessage
+				if !errors.As(err, &me) {
+					t.Fatalf("expected message error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if req != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, req)
+			}
+		})
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	d := NewDecoder()
+	prefix := []byte{0, 0}
+
+	var resp Response
+	var fields []headerField
+	in := appendLiteral(inst.AppendStaticIndexReference(prefix, staticStatus200), "x-a", "1")
+	err := d.DecodeResponse(0, in, &resp, func(name, value string) {
+		fields = append(fields, headerField{name, value})
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resp.StatusCode != 200 || len(fields) != 1 || fields[0] != (headerField{"X-A", "1"}) {
+		t.Errorf("unexpected response %+v, %v", resp, fields)
+	}
+
+	for _, in := range [][]byte{
+		prefix,
+		appendLiteral(prefix, ":status", "20"),
+		appendLiteral(prefix, ":status", "abc"),
+		inst.AppendStaticIndexReference(inst.AppendStaticIndexReference(prefix, staticStatus200), staticMethodGET),
+	} {
+		var me ErrMessage
+		if err := d.DecodeResponse(0, in, &resp, func(string, string) {}, nil); !errors.As(err, &me) {
+			t.Errorf("expected message error for %x, got %v", in, err)
+		}
+	}
+
+	var me ErrMessage
+	err = d.DecodeTrailers(0, inst.AppendStaticIndexReference(prefix, staticStatus200), func(string, string) {}, nil)
+	if !errors.As(err, &me) || !errors.Is(err, errPseudoInTrailers) {
+		t.Errorf("expected pseudo-header in trailers error, got %v", err)
+	}
+	if err := d.DecodeTrailers(0, appendLiteral(prefix, "grpc-status", "0"), func(string, string) {}, nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDecodeRequestBlocked(t *testing.T) {
+	e := NewEncoder(MaxTableCapacity(4096), MaxBlockedStreams(16))
+	d := NewDecoder(MaxTableCapacity(4096), MaxBlockedStreams(16))
+
+	p, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/", map[string][]string{"X-A": {"1"}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var req Request
+	done := make(chan error, 1)
+	if err := d.DecodeRequest(0, p, &req, func(string, string) {}, func(err error) { done <- err }); err != ErrBlocked {
+		t.Fatalf("expected blocked, got %v", err)
+	}
+	if err := d.ParseEncoderInstructions(e.AppendEncoderInstructions(nil)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if req.Method != "GET" || req.Authority != "example.com" {
+		t.Errorf("unexpected request %+v", req)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	e := NewEncoder(Strict())
+	for _, header := range []map[string][]string{
+		{"Connection": {"close"}},
+		{"Keep-Alive": {"timeout=5"}},
+		{"Proxy-Connection": {"keep-alive"}},
+		{"Transfer-Encoding": {"chunked"}},
+		{"Upgrade": {"websocket"}},
+		{"Te": {"gzip"}},
+		{"X-A": {"1\r\nX-B: 2"}},
+		{"X-A": {"\x00"}},
+		{"X A": {"1"}},
+	} {
+		if _, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/", header); err == nil {
+			t.Errorf("expected error encoding %q", header)
+		}
+		if _, err := NewEncoder().AppendRequest(nil, 0, "GET", "https", "example.com", "/", header); err != nil {
+			t.Errorf("unexpected error encoding %q without Strict, %v", header, err)
+		}
+	}
+	if _, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/\r\n", nil); err == nil {
+		t.Errorf("expected error encoding :path with CRLF")
+	}
+	if _, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/", map[string][]string{"Te": {"trailers"}}); err != nil {
+		t.Errorf("unexpected error encoding TE: trailers, %v", err)
+	}
+
+	prefix := []byte{0, 0}
+	get := func() []byte {
+		p := inst.AppendStaticIndexReference(prefix, staticMethodGET)
+		p = inst.AppendStaticIndexReference(p, staticSchemeTLS)
+		return inst.AppendStaticIndexReference(p, staticPath)
+	}
+	// Literal Field Line with Literal Name X-A: 1, without lower casing.
+	upper := append(get(), 0x23, 'X', '-', 'A', 0x01, '1')
+
+	for _, tt := range []struct {
+		name string
+		in   []byte
+	}{
+		{"connection", appendLiteral(get(), "connection", "close")},
+		{"te", appendLiteral(get(), "te", "gzip")},
+		{"uppercase", upper},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var me ErrMessage
+			var req Request
+			d := NewDecoder(Strict())
+			if err := d.DecodeRequest(0, tt.in, &req, func(string, string) {}, nil); !errors.As(err, &me) {
+				t.Errorf("expected message error, got %v", err)
+			}
+			if err := NewDecoder().DecodeRequest(0, tt.in, &req, func(string, string) {}, nil); err != nil {
+				t.Errorf("unexpected error without Strict, %v", err)
+			}
+		})
+	}
+
+	// Insert with Literal Name X-A: 1, without lower casing, is accepted,
+	// but field sections referencing it are malformed.
+	insert := inst.AppendSetDynamicTableCapacity(nil, 4096)
+	insert = append(insert, 0x43, 'X', '-', 'A', 0x01, '1')
+	// Required Insert Count 1, Indexed Field Line with relative index 0.
+	section := []byte{0x02, 0x00, 0x80}
+	for _, strict := range []bool{false, true} {
+		opts := []Option{MaxTableCapacity(4096)}
+		if strict {
+			opts = append(opts, Strict())
+		}
+		d := NewDecoder(opts...)
+		if err := d.ParseEncoderInstructions(insert); err != nil {
+			t.Fatalf("unexpected encoder stream error %v", err)
+		}
+		var me ErrMessage
+		err := d.Decode(0, section, func(string, string) {}, nil)
+		if strict && !errors.As(err, &me) {
+			t.Errorf("expected message error, got %v", err)
+		}
+		if !strict && err != nil {
+			t.Errorf("unexpected error without Strict, %v", err)
+		}
+	}
+}
+
+func TestStrictEncoderStream(t *testing.T) {
+	d := NewDecoder(MaxTableCapacity(4096), Strict())
+
+	// Insert with Literal Name x-foo: bar, and :protocol: websocket, fed a
+	// byte at a time.
+	in := inst.AppendSetDynamicTableCapacity(nil, 4096)
+	in = append(in, 0x45, 'x', '-', 'f', 'o', 'o', 0x03, 'b', 'a', 'r')
+	in = append(in, 0x49, ':', 'p', 'r', 'o', 't', 'o', 'c', 'o', 'l')
+	in = append(in, 0x09, 'w', 'e', 'b', 's', 'o', 'c', 'k', 'e', 't')
+	for i := range in {
+		if err := d.ParseEncoderInstructions(in[i : i+1]); err != nil {
+			t.Fatalf("unexpected encoder stream error at byte %d, %v", i, err)
+		}
+	}
+	// Required Insert Count 2, Indexed Field Line with relative index 1.
+	var got []string
+	err := d.Decode(0, []byte{0x03, 0x00, 0x81}, func(name, value string) {
+		got = append(got, name+": "+value)
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if len(got) != 1 || got[0] != "X-Foo: bar" {
+		t.Errorf("expected X-Foo: bar, got %q", got)
+	}
+}
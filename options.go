@@ -0,0 +1,143 @@
+package quack
+
+import (
+	"math"
+
+	"github.com/renthraysk/quack/internal/field"
+)
+
+// options holds the configuration shared by Encoders and Decoders. Settings
+// mirror the HTTP/3 SETTINGS that govern the decoding side of a QPACK
+// connection, for a Decoder the values advertised, for an Encoder the values
+// the peer advertised.
+type options struct {
+	maxTableCapacity    uint64
+	maxBlockedStreams   uint64
+	maxFieldSectionSize uint64
+	nonBlocking         bool
+	sortedFields        bool
+	strict              bool
+	sensitivity         field.Policy
+	insertLimits        field.InsertLimits
+}
+
+// Option configures an Encoder or Decoder.
+type Option func(*options)
+
+// MaxTableCapacity sets SETTINGS_QPACK_MAX_TABLE_CAPACITY, the upper bound
+// on the dynamic table capacity. Defaults to 0, static table only.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-maximum-dynamic-table-capac
+func MaxTableCapacity(capacity uint64) Option {
+	return func(o *options) { o.maxTableCapacity = capacity }
+}
+
+// MaxBlockedStreams sets SETTINGS_QPACK_BLOCKED_STREAMS, the number of
+// streams that can be blocked awaiting dynamic table inserts. Defaults to 0.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-blocked-streams
+func MaxBlockedStreams(n uint64) Option {
+	return func(o *options) { o.maxBlockedStreams = n }
+}
+
+// MaxFieldSectionSize sets SETTINGS_MAX_FIELD_SECTION_SIZE, the limit on the
+// size of a field section, the sum of the length of each name and value plus
+// 32. Defaults to 0, unlimited.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-header-size-constraints
+func MaxFieldSectionSize(size uint64) Option {
+	return func(o *options) { o.maxFieldSectionSize = size }
+}
+
+// NonBlocking restricts an Encoder to only reference dynamic table entries
+// the peer's decoder has acknowledged, so field sections never block. New
+// entries are still inserted for use once acknowledged. Field sections are
+// then encoded without waiting on changes to the dynamic table. Implied by a
+// MaxBlockedStreams of 0.
+func NonBlocking() Option {
+	return func(o *options) { o.nonBlocking = true }
+}
+
+// SortedFields has an Encoder encode the fields of maps in name order, rather
+// than map iteration order, so identical inputs produce identical encodings.
+func SortedFields() Option {
+	return func(o *options) { o.sortedFields = true }
+}
+
+// Strict has an Encoder refuse to encode, and a Decoder reject, fields that
+// are connection-specific, such as Connection or Transfer-Encoding, or
+// malformed. Decoders also reject literal names containing uppercase
+// characters.
+// https://www.rfc-editor.org/rfc/rfc9114.html#name-malformed-requests-and-resp
+func Strict() Option {
+	return func(o *options) { o.strict = true }
+}
+
+// Sensitivity determines how an Encoder may compress a field, to protect
+// sensitive values from compression based attacks.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-never-indexed-literals
+type Sensitivity = field.Control
+
+const (
+	// NeverIndex fields are never inserted into the dynamic table, and are
+	// encoded as never indexed literals, which intermediaries preserve.
+	NeverIndex Sensitivity = field.NeverIndex
+	// NeverHuffman field values are never Huffman encoded, so their encoded
+	// length does not depend on their content.
+	NeverHuffman Sensitivity = field.NeverHuffman
+)
+
+// DefaultSensitivity returns the Sensitivity of a field absent the
+// SensitiveFields option. Authorization and Content-Md5 values are never
+// indexed nor Huffman encoded, and fields such as Set-Cookie, Date and Etag,
+// whose values are unique or short lived, are never indexed.
+func DefaultSensitivity(name, value string) Sensitivity {
+	return field.DefaultPolicy(name, value)
+}
+
+// SensitiveFields has an Encoder call sensitivity, in place of
+// DefaultSensitivity, for the Sensitivity of each field encoded. Names are
+// as given to the Encoder, canonical for an http.Header, and Cookie fields
+// are passed per crumb. Fields marked NeverIndex are never indexed
+// regardless.
+func SensitiveFields(sensitivity func(name, value string) Sensitivity) Option {
+	return func(o *options) { o.sensitivity = sensitivity }
+}
+
+// MaxEntriesPerName limits the dynamic table entries of the same field name
+// an Encoder inserts to n, so guesses at a sensitive value can not displace
+// each other's entries at will. Defaults to 0, unlimited.
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-mitigation
+func MaxEntriesPerName(n uint64) Option {
+	return func(o *options) { o.insertLimits.MaxEntries = n }
+}
+
+// MinInsertValueLength has an Encoder only insert values of at least n bytes
+// into the dynamic table, as shorter values are more readily guessed. Only
+// the names of fields with shorter values are inserted. Defaults to 0, values
+// of any length inserted.
+func MinInsertValueLength(n uint64) Option {
+	return func(o *options) { o.insertLimits.MinValueLength = n }
+}
+
+// MaxInsertsPerName has an Encoder encode the fields of a name as never
+// indexed literals once n distinct values of it have been inserted into the
+// dynamic table, as each may be a failed guess at a sensitive value.
+// Defaults to 0, unlimited.
+func MaxInsertsPerName(n uint64) Option {
+	return func(o *options) { o.insertLimits.MaxInserts = n }
+}
+
+// fieldSectionSizeLimit returns the field section size limit,
+// math.MaxUint64 if unlimited.
+func (o *options) fieldSectionSizeLimit() uint64 {
+	if o.maxFieldSectionSize == 0 {
+		return math.MaxUint64
+	}
+	return o.maxFieldSectionSize
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,69 @@
+// Package quicvarint implements the QUIC variable-length integer encoding,
+// used by HTTP/3 for stream types, frame types, frame lengths & settings.
+// https://www.rfc-editor.org/rfc/rfc9000.html#name-variable-length-integer-enc
+package quicvarint
+
+import (
+	"github.com/renthraysk/quack/varint"
+)
+
+// Max is the largest value that can be encoded.
+const Max = (1 << 62) - 1
+
+// ErrUnexpectedEnd is returned when p ends before the varint does. The same
+// error as varint.ErrUnexpectedEnd.
+var ErrUnexpectedEnd = varint.ErrUnexpectedEnd
+
+// Read decodes the varint at the start of p, returning it and the remainder
+// of p. On error p is returned unchanged.
+func Read(p []byte) (uint64, []byte, error) {
+	if len(p) <= 0 {
+		return 0, p, ErrUnexpectedEnd
+	}
+	n := PrefixLen(p[0])
+	if len(p) < n {
+		return 0, p, ErrUnexpectedEnd
+	}
+	x := uint64(p[0] & 0x3F)
+	for _, b := range p[1:n] {
+		x = x<<8 | uint64(b)
+	}
+	return x, p[n:], nil
+}
+
+// Append appends the shortest encoding of x to p. Panics if x exceeds Max.
+func Append(p []byte, x uint64) []byte {
+	switch {
+	case x <= 0x3F:
+		return append(p, byte(x))
+	case x <= 0x3FFF:
+		return append(p, 0x40|byte(x>>8), byte(x))
+	case x <= 0x3FFF_FFFF:
+		return append(p, 0x80|byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+	case x <= Max:
+		return append(p, 0xC0|byte(x>>56), byte(x>>48), byte(x>>40), byte(x>>32),
+			byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+	}
+	panic("quicvarint: value exceeds 2^62-1")
+}
+
+// Len returns the length of the shortest encoding of x. Panics if x exceeds
+// Max.
+func Len(x uint64) int {
+	switch {
+	case x <= 0x3F:
+		return 1
+	case x <= 0x3FFF:
+		return 2
+	case x <= 0x3FFF_FFFF:
+		return 4
+	case x <= Max:
+		return 8
+	}
+	panic("quicvarint: value exceeds 2^62-1")
+}
+
+// PrefixLen returns the length of the varint whose first byte is b.
+func PrefixLen(b byte) int {
+	return 1 << (b >> 6)
+}
@@ -0,0 +1,68 @@
+package quicvarint
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          []byte
+		expected    uint64
+		expectedErr error
+	}{
+		// https://www.rfc-editor.org/rfc/rfc9000.html#name-sample-variable-length-inte
+		{"rfc9000_a1_1", []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}, 151288809941952652, nil},
+		{"rfc9000_a1_2", []byte{0x9d, 0x7f, 0x3e, 0x7d}, 494878333, nil},
+		{"rfc9000_a1_3", []byte{0x7b, 0xbd}, 15293, nil},
+		{"rfc9000_a1_4", []byte{0x25}, 37, nil},
+		{"rfc9000_a1_5", []byte{0x40, 0x25}, 37, nil},
+
+		{"empty", []byte{}, 0, ErrUnexpectedEnd},
+		{"short-2", []byte{0x40}, 0, ErrUnexpectedEnd},
+		{"short-4", []byte{0x80, 0, 0}, 0, ErrUnexpectedEnd},
+		{"short-8", []byte{0xc0, 0, 0, 0, 0, 0, 0}, 0, ErrUnexpectedEnd},
+		{"max", Append(nil, Max), Max, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, r, err := Read(tt.in)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("unexpected error expected %v, got %v", tt.expectedErr, err)
+			}
+			if x != tt.expected {
+				t.Errorf("expected x to be %d, got %d", tt.expected, x)
+			}
+			if err != nil {
+				if len(tt.in) > 0 && &tt.in[0] != &r[0] {
+					t.Error("expected remain to be unchanged")
+				}
+			} else if len(r) != 0 {
+				t.Errorf("expected remain to be empty")
+			}
+		})
+	}
+}
+
+func TestAppend(t *testing.T) {
+	for _, x := range []uint64{0, 37, 0x3F, 0x40, 15293, 0x3FFF, 0x4000, 494878333, 0x3FFF_FFFF, 0x4000_0000, 151288809941952652, Max} {
+		p := Append(nil, x)
+		if len(p) != Len(x) {
+			t.Errorf("expected length %d for %d, got %d", Len(x), x, len(p))
+		}
+		if PrefixLen(p[0]) != len(p) {
+			t.Errorf("expected prefix length %d for %d, got %d", len(p), x, PrefixLen(p[0]))
+		}
+		y, r, err := Read(p)
+		if err != nil || y != x || len(r) != 0 {
+			t.Errorf("round trip of %d, got %d, %v", x, y, err)
+		}
+	}
+	if testing.AllocsPerRun(10, func() {
+		var buf [8]byte
+		Append(buf[:0], Max)
+	}) != 0 {
+		t.Error("expected no allocations")
+	}
+}
@@ -1,10 +1,29 @@
 package quack
 
+import "github.com/renthraysk/quack/internal/field"
+
+// stream tracks the field sections of a request stream that reference the
+// dynamic table, and are yet to be acknowledged by the peer's decoder, in the
+// order they were encoded.
 type stream struct {
+	sections []*field.Section
 }
 
-func (s *stream) streamCancellation() {
+// streamCancellation removes all unacknowledged field sections, returning
+// them.
+func (s *stream) streamCancellation() []*field.Section {
+	sections := s.sections
+	s.sections = nil
+	return sections
 }
 
-func (s *stream) sectionAcknowledgement() {
+// sectionAcknowledgement removes the oldest unacknowledged field section,
+// returning it. Returns false if there was none.
+func (s *stream) sectionAcknowledgement() (*field.Section, bool) {
+	if len(s.sections) == 0 {
+		return nil, false
+	}
+	sec := s.sections[0]
+	s.sections = s.sections[1:]
+	return sec, true
 }
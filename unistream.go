@@ -0,0 +1,191 @@
+package quack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/renthraysk/quack/quicvarint"
+)
+
+// https://www.rfc-editor.org/rfc/rfc9204.html#name-encoder-and-decoder-streams
+
+const (
+	EncoderStreamType = 0x02
+	DecoderStreamType = 0x03
+)
+
+var errCriticalStreamEOF = errors.New("end of stream")
+
+// signal notifies a waiting StreamWriter without blocking.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// StreamWriter writes the stream type, followed by pending instructions of an
+// Encoder or Decoder as they are queued, to a unidirectional stream. Only one
+// StreamWriter should be created for each Encoder or Decoder.
+type StreamWriter struct {
+	w                  io.Writer
+	pending            <-chan struct{}
+	appendInstructions func(p []byte) []byte
+
+	close chan struct{}
+	done  chan struct{}
+	err   error
+}
+
+// NewEncoderStreamWriter starts writing the encoder stream of e to w.
+func NewEncoderStreamWriter(e *Encoder, w io.Writer) *StreamWriter {
+	return newStreamWriter(w, EncoderStreamType, e.pending, e.AppendEncoderInstructions)
+}
+
+// NewDecoderStreamWriter starts writing the decoder stream of d to w.
+func NewDecoderStreamWriter(d *Decoder, w io.Writer) *StreamWriter {
+	return newStreamWriter(w, DecoderStreamType, d.pending, d.AppendDecoderInstructions)
+}
+
+func newStreamWriter(w io.Writer, streamType uint64, pending <-chan struct{}, appendInstructions func(p []byte) []byte) *StreamWriter {
+	sw := &StreamWriter{
+		w:                  w,
+		pending:            pending,
+		appendInstructions: appendInstructions,
+		close:              make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+	go sw.run(streamType)
+	return sw
+}
+
+func (sw *StreamWriter) run(streamType uint64) {
+	defer close(sw.done)
+
+	p := quicvarint.Append(nil, streamType)
+	for {
+		if p = sw.appendInstructions(p); len(p) > 0 {
+			if _, err := sw.w.Write(p); err != nil {
+				sw.err = ErrClosedCriticalStream{err}
+				return
+			}
+			p = p[:0]
+		}
+		select {
+		case <-sw.pending:
+		case <-sw.close:
+			if p = sw.appendInstructions(p); len(p) > 0 {
+				if _, err := sw.w.Write(p); err != nil {
+					sw.err = ErrClosedCriticalStream{err}
+				}
+			}
+			return
+		}
+	}
+}
+
+// Done returns a channel that is closed once the StreamWriter has stopped.
+func (sw *StreamWriter) Done() <-chan struct{} { return sw.done }
+
+// Close writes any pending instructions, and stops the StreamWriter. The
+// underlying io.Writer is not closed. Returns an ErrClosedCriticalStream if a
+// write failed.
+func (sw *StreamWriter) Close() error {
+	select {
+	case <-sw.done:
+	default:
+		close(sw.close)
+		<-sw.done
+	}
+	return sw.err
+}
+
+// StreamReader verifies the stream type of a unidirectional stream, then
+// parses the instructions read from it into an Encoder or Decoder. The
+// StreamReader stops on error, including the stream ending, which is
+// reported as an ErrClosedCriticalStream.
+type StreamReader struct {
+	r     io.Reader
+	parse func(in []byte) error
+
+	done chan struct{}
+	err  error
+}
+
+// NewEncoderStreamReader starts reading the peer's encoder stream from r into
+// d.
+func NewEncoderStreamReader(d *Decoder, r io.Reader) *StreamReader {
+	return newStreamReader(r, EncoderStreamType, d.ParseEncoderInstructions)
+}
+
+// NewDecoderStreamReader starts reading the peer's decoder stream from r into
+// e.
+func NewDecoderStreamReader(e *Encoder, r io.Reader) *StreamReader {
+	return newStreamReader(r, DecoderStreamType, e.ParseDecoderInstructions)
+}
+
+func newStreamReader(r io.Reader, streamType uint64, parse func(in []byte) error) *StreamReader {
+	sr := &StreamReader{
+		r:     r,
+		parse: parse,
+		done:  make(chan struct{}),
+	}
+	go sr.run(streamType)
+	return sr
+}
+
+func (sr *StreamReader) run(streamType uint64) {
+	defer close(sr.done)
+
+	t, err := readVarint(sr.r)
+	if err == io.EOF {
+		err = errCriticalStreamEOF
+	}
+	if err != nil {
+		sr.err = ErrClosedCriticalStream{err}
+		return
+	}
+	if t != streamType {
+		sr.err = ErrStreamCreation{fmt.Errorf("unexpected stream type %#x", t)}
+		return
+	}
+	var buf [4096]byte
+	for {
+		n, err := sr.r.Read(buf[:])
+		if n > 0 {
+			if err := sr.parse(buf[:n]); err != nil {
+				sr.err = err
+				return
+			}
+		}
+		if err == io.EOF {
+			err = errCriticalStreamEOF
+		}
+		if err != nil {
+			sr.err = ErrClosedCriticalStream{err}
+			return
+		}
+	}
+}
+
+// Done returns a channel that is closed once the StreamReader has stopped.
+func (sr *StreamReader) Done() <-chan struct{} { return sr.done }
+
+// Err returns the error that stopped the StreamReader, or nil if it is still
+// running.
+func (sr *StreamReader) Err() error {
+	select {
+	case <-sr.done:
+		return sr.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the StreamReader stops, returning the error that stopped
+// it.
+func (sr *StreamReader) Wait() error {
+	<-sr.done
+	return sr.err
+}
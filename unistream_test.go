@@ -0,0 +1,101 @@
+package quack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestStreamsOverPipe(t *testing.T) {
+	e := NewEncoder(MaxTableCapacity(4096), MaxBlockedStreams(16))
+	d := NewDecoder(MaxTableCapacity(4096), MaxBlockedStreams(16))
+
+	// Encoder stream, from e to d.
+	es0, es1 := net.Pipe()
+	ew := NewEncoderStreamWriter(e, es0)
+	er := NewEncoderStreamReader(d, es1)
+	// Decoder stream, from d to e.
+	ds0, ds1 := net.Pipe()
+	dw := NewDecoderStreamWriter(d, ds0)
+	dr := NewDecoderStreamReader(e, ds1)
+
+	header := map[string][]string{"x-custom": {"value"}}
+	p, err := e.AppendRequest(nil, 0, "GET", "https", "example.com", "/", header)
+	if err != nil {
+		t.Fatalf("unexpected encode error %v", err)
+	}
+	if len(e.streams) != 1 {
+		t.Fatalf("expected field section to reference the dynamic table")
+	}
+
+	var fields []headerField
+	accept := func(name, value string) {
+		fields = append(fields, headerField{name, value})
+	}
+	done := make(chan error, 1)
+	switch err := d.Decode(0, p, accept, func(err error) { done <- err }); err {
+	case ErrBlocked:
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected decode error %v", err)
+		}
+	case nil:
+	default:
+		t.Fatalf("unexpected decode error %v", err)
+	}
+	if len(fields) != 5 || fields[4] != (headerField{"X-Custom", "value"}) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+
+	// Flush the Section Acknowledgement, then close the decoder stream.
+	if err := dw.Close(); err != nil {
+		t.Fatalf("unexpected decoder stream writer error %v", err)
+	}
+	ds0.Close()
+	var cs ErrClosedCriticalStream
+	if err := dr.Wait(); !errors.As(err, &cs) {
+		t.Fatalf("expected closed critical stream error, got %v", err)
+	}
+	if cs.ErrorCode() != H3ClosedCriticalStream {
+		t.Errorf("unexpected error code %#x", cs.ErrorCode())
+	}
+	if len(e.streams) != 0 {
+		t.Errorf("expected field section to be acknowledged")
+	}
+
+	if err := ew.Close(); err != nil {
+		t.Fatalf("unexpected encoder stream writer error %v", err)
+	}
+	es0.Close()
+	if err := er.Wait(); !errors.As(err, &cs) {
+		t.Fatalf("expected closed critical stream error, got %v", err)
+	}
+}
+
+func TestStreamReaderStreamType(t *testing.T) {
+	d := NewDecoder(MaxTableCapacity(4096))
+
+	r, w := io.Pipe()
+	sr := NewEncoderStreamReader(d, r)
+	go func() {
+		w.Write([]byte{DecoderStreamType})
+		w.Close()
+	}()
+	var sc ErrStreamCreation
+	if err := sr.Wait(); !errors.As(err, &sc) {
+		t.Fatalf("expected stream creation error, got %v", err)
+	}
+}
+
+func TestStreamWriterClosed(t *testing.T) {
+	e := NewEncoder(MaxTableCapacity(4096))
+
+	r, w := io.Pipe()
+	r.Close()
+	sw := NewEncoderStreamWriter(e, w)
+	<-sw.Done()
+	var cs ErrClosedCriticalStream
+	if err := sw.Close(); !errors.As(err, &cs) {
+		t.Fatalf("expected closed critical stream error, got %v", err)
+	}
+}
@@ -7,12 +7,13 @@ const (
 	maxVarint62Len = (62 + 6) / 7
 )
 
-var errUnexpectedEnd = errors.New("quack: unexpected end")
+// ErrUnexpectedEnd is returned when p ends before the varint does.
+var ErrUnexpectedEnd = errors.New("quack: unexpected end")
 var errVarintOverflow = errors.New("quack: varint overflow")
 
 func Read(p []byte, mask uint8) (uint64, []byte, error) {
 	if len(p) <= 0 {
-		return 0, p, errUnexpectedEnd
+		return 0, p, ErrUnexpectedEnd
 	}
 	x, q := uint64(p[0]&mask), p[1:]
 	if x < uint64(mask) {
@@ -35,7 +36,7 @@ func Read(p []byte, mask uint8) (uint64, []byte, error) {
 	// either no bytes or all continuation bits were set
 	if len(q) < maxVarint62Len {
 		// Looks like a truncated varint
-		return 0, p, errUnexpectedEnd
+		return 0, p, ErrUnexpectedEnd
 	}
 	return 0, p, errVarintOverflow
 }
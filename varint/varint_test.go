@@ -21,7 +21,7 @@ func TestReadVarint(t *testing.T) {
 		{"rfc7541_c1_2", []byte{0b11111, 0b1001_1010, 0b000_1010}, 0x1F, 1337, nil},
 		{"rfc7541_c1_3", []byte{0b00101010}, 0xFF, 42, nil},
 
-		{"empty", []byte{}, 0x01, 0, errUnexpectedEnd},
+		{"empty", []byte{}, 0x01, 0, ErrUnexpectedEnd},
 		{"zero-7", []byte{0x00}, 0x7F, 0, nil},
 		{"one-1", []byte{0x01, 0x00}, 0x01, 1, nil},
 
@@ -32,11 +32,11 @@ func TestReadVarint(t *testing.T) {
 		{"overflow-7", Append(nil, 0, 0x7F, maxVarint62+1), 0x7F, 0, errVarintOverflow},
 		{"overflow-8", Append(nil, 0, 0xFF, maxVarint62+1), 0xFF, 0, errVarintOverflow},
 
-		{"short", bad[:9], 0x7F, 0, errUnexpectedEnd},
+		{"short", bad[:9], 0x7F, 0, ErrUnexpectedEnd},
 		{"overflow", bad[:10], 0x7F, 0, errVarintOverflow},
 		{"long", bad[:], 0x7F, 0, errVarintOverflow},
 
-		{"eos", []byte{0x7F, 0x80}, 0x7F, 0, errUnexpectedEnd},
+		{"eos", []byte{0x7F, 0x80}, 0x7F, 0, ErrUnexpectedEnd},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {